@@ -1,23 +1,37 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
 	"github.com/chrisruffalo/keycloak-sync/sync"
+	userapi "github.com/openshift/api/user/v1"
+	userclient "github.com/openshift/client-go/user/clientset/versioned"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"io"
-	serializer "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/client-go/kubernetes"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
 	_EXIT_OK = 0
+	// the diff found changes
+	_EXIT_CHANGES = 2
+	// the sync finished without one or more optional realms
+	_EXIT_PARTIAL = 3
 	// configuration issues
 	_ERROR_NO_CONFIG      = 100
 	_ERROR_CONFIG_MISSING = 101
 	_ERROR_READING_CONFIG = 102
+	// cluster issues
+	_ERROR_CLUSTER_CONNECT = 110
+	_ERROR_CLUSTER_APPLY   = 111
 )
 
 /*
@@ -29,6 +43,20 @@ func main() {
 	pflag.StringP("config", "c", "keycloak-sync.yml", "The path to the config file that drives the configuration. A config file is required.")
 	pflag.StringP("groups", "g", "", "The path to the OpenShift group list file (yaml or json) that should be used to reconcile the groups from Keycloak/SSO. Use \"-\" to provide on stdin.")
 	pflag.StringP("format", "f", "yaml", "The output format, either json or yaml. If json is not chosen any other value will result in yaml. Not case sensitive.")
+	pflag.StringP("deletions", "d", "", "The path to write the groups that should be deleted because of the \"prune-groups\" option. The file can be given to \"oc delete -f\". Use \"-\" to write to stderr.")
+	pflag.String("diff", "", "Show the changes that would be made to each group instead of the groups themselves, nothing is applied. The format is text, json, or unified and is text if no format is given. Exits with 2 if there are changes.")
+	pflag.Lookup("diff").NoOptDefVal = "text"
+	pflag.BoolP("apply", "a", false, "Read the current groups from the cluster and apply the changes directly instead of printing them. The \"groups\" option is ignored.")
+	pflag.StringP("kubeconfig", "k", "", "The path to the kubeconfig used with \"apply\". If not given the service account is used when running in a pod, otherwise the default kubeconfig is used.")
+	pflag.Bool("serve", false, "Run as a controller that applies the groups to the cluster on an interval instead of running once.")
+	pflag.Duration("interval", 5*time.Minute, "The time to wait between each reconcile when running with \"serve\".")
+	pflag.Float64("jitter", 0.1, "The fraction of the interval, up to, that is randomly added to each wait when running with \"serve\".")
+	pflag.String("listen", ":8080", "The address for the /healthz, /readyz, and /metrics endpoints when running with \"serve\". Set to empty to disable.")
+	pflag.Bool("leader-elect", false, "Use a Kubernetes Lease so that only one replica reconciles at a time when running with \"serve\".")
+	pflag.String("lease-name", "keycloak-sync", "The name of the Lease used for leader election.")
+	pflag.String("lease-namespace", "", "The namespace of the Lease used for leader election. Defaults to the namespace of the pod.")
+	pflag.Bool("synced-at", false, "Write the \"keycloak-sync/synced-at\" annotation on the groups that are written out. The output then changes every run. Groups applied to the cluster always have it.")
+	pflag.String("metrics-file", "", "The path to write the Prometheus metrics for the run to when not running with \"serve\". The file can be read by the node exporter textfile collector or pushed to a Pushgateway.")
 	pflag.BoolP("keycloak-debug", "D", false, "Debug the rest input/output of the keycloak exchange.")
 	pflag.BoolP("help", "h", false, "Print the help message")
 	pflag.Parse()
@@ -68,13 +96,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	// run as a controller until stopped
+	if viper.GetBool("serve") {
+		os.Exit(serve(config))
+	}
+
 	// if we want to track just changed groups this brings in groups from openshift for that
 	onlyChanged := false
 
+	// when applying directly to the cluster the current groups come from the cluster
+	apply := viper.GetBool("apply")
+	var clusterClient userclient.Interface
+	var clusterGroups userapi.GroupList
+
 	// if openshift groups are provided, read them by figuring out the reader
 	openshiftGroups := sync.GroupList{}
 	groupsFileName := strings.TrimSpace(viper.GetString("groups"))
-	if len(groupsFileName) > 0 {
+	if apply {
+		clusterClient, err = sync.NewOpenShiftClient(viper.GetString("kubeconfig"))
+		if err != nil {
+			logrus.Errorf("Could not create OpenShift client: %s", err)
+			finish(_ERROR_CLUSTER_CONNECT, err)
+		}
+		clusterGroups, err = sync.GetOpenShiftGroupsFromCluster(context.Background(), clusterClient)
+		if err != nil {
+			logrus.Errorf("Could not read OpenShift groups from the cluster: %s", err)
+			finish(_ERROR_CLUSTER_CONNECT, err)
+		}
+		openshiftGroups = sync.FromOpenShiftGroups(config, clusterGroups)
+		onlyChanged = true
+	} else if len(groupsFileName) > 0 {
 		var reader io.Reader
 		if groupsFileName == "-" {
 			reader = os.Stdin
@@ -82,42 +133,205 @@ func main() {
 			reader, err = os.Open(groupsFileName)
 			if err != nil {
 				logrus.Errorf("Could not open OpenShift groups file: %s", err)
-				os.Exit(1)
+				finish(1, err)
 			}
 		} else {
 			logrus.Errorf("No file named '%s' fround as source for OpenShift groups", groupsFileName)
-			os.Exit(1)
+			finish(1, fileErr)
 		}
 		openshiftGroups, err = sync.GetOpenShiftGroupsFromReader(config, reader)
 		if err != nil {
 			logrus.Errorf("Could not read OpenShift group information from '%s': %s", groupsFileName, err)
-			os.Exit(1)
+			finish(1, err)
 		}
 		onlyChanged = true
 	}
 
+	// credentials in a kubernetes secret can only be read when there is a connection to the cluster
+	sessions := sync.NewKeycloakSessions()
+	if config.UsesSecretRefs() {
+		if !apply {
+			logrus.Error("Credentials in a Kubernetes Secret can only be read with \"apply\"")
+			finish(_ERROR_READING_CONFIG, fmt.Errorf("secret references need apply"))
+		}
+		kubeClient, err := sync.NewKubernetesClient(viper.GetString("kubeconfig"))
+		if err != nil {
+			logrus.Errorf("Could not create Kubernetes client: %s", err)
+			finish(_ERROR_CLUSTER_CONNECT, err)
+		}
+		sessions.SetSecretReader(sync.NewSecretReader(kubeClient))
+	}
+
 	// get groups providing the openshift groups as the target for merging on to
-	keycloakGroups, err := sync.GetKeycloakGroups(config)
-	if err != nil {
+	keycloakGroups, err := sessions.GetKeycloakGroups(context.Background(), config)
+	sessions.Close()
+	partial, _ := sync.AsPartialSync(err)
+	if err != nil && partial == nil {
 		logrus.Errorf("An unrecoverable error occurred during sync: %s", err)
-		os.Exit(1)
+		finish(1, err)
+	}
+
+	// keep keycloak groups from changing openshift groups that keycloak-sync doesn't own
+	openshiftGroups, keycloakGroups, err = sync.ResolveCollisions(config, openshiftGroups, keycloakGroups)
+	if err != nil {
+		logrus.Errorf("Could not resolve group collisions: %s", err)
+		finish(1, err)
+	}
+
+	// groups from optional realms that could not be read are not pruned or deleted
+	if partial != nil {
+		openshiftGroups = sync.KeepFailedRealmGroups(openshiftGroups, partial.FailedRealms())
 	}
 
 	finalGroups := sync.Merge(openshiftGroups, keycloakGroups)
 
 	// create openshift groups
 	outputGroups := finalGroups.ToOpenShiftGroups(config, onlyChanged)
+	deletedGroups := finalGroups.ToOpenShiftGroupDeletions(config)
+
+	// show the changes instead of making or writing them
+	diffFormat := strings.TrimSpace(viper.GetString("diff"))
+	if len(diffFormat) > 0 {
+		diffs := sync.Diff(config, openshiftGroups, finalGroups)
+		err = diffs.Write(diffFormat, os.Stdout)
+		if err != nil {
+			logrus.Errorf("Error writing changes: %s", err)
+			finish(1, err)
+		}
+		if diffs.HasChanges() {
+			finishSync(_EXIT_CHANGES, partial)
+		}
+		finishSync(_EXIT_OK, partial)
+	}
+
+	// apply groups to the cluster instead of writing them out
+	if apply {
+		deletions := make([]string, 0, len(deletedGroups.Items))
+		for _, group := range deletedGroups.Items {
+			deletions = append(deletions, group.Name)
+		}
+		result, err := sync.ApplyOpenShiftGroups(context.Background(), clusterClient, clusterGroups, finalGroups.WithSyncedAt(outputGroups), deletions)
+		logrus.Infof("Groups created: %d, updated: %d, deleted: %d", len(result.Created), len(result.Updated), len(result.Deleted))
+		if err != nil {
+			logrus.Errorf("Error applying groups to the cluster: %s", err)
+			finish(_ERROR_CLUSTER_APPLY, err)
+		}
+		finishSync(_EXIT_OK, partial)
+	}
+
+	// the groups are applied by whatever reads the output so count the changes here
+	sync.Diff(config, openshiftGroups, finalGroups).Observe()
+
+	// the sync time changes every run so it is only written out when it is asked for
+	if viper.GetBool("synced-at") {
+		outputGroups = finalGroups.WithSyncedAt(outputGroups)
+	}
 
 	// encode to output format
 	format := strings.ToLower(strings.TrimSpace(viper.GetString("format")))
-	ser := serializer.NewSerializerWithOptions(serializer.DefaultMetaFactory, nil, nil, serializer.SerializerOptions{
-		Yaml:   "json" != format,
-		Pretty: true,
-		Strict: true,
-	})
-	err = ser.Encode(&outputGroups, os.Stdout)
+	err = sync.WriteOpenShiftGroups(outputGroups, format, os.Stdout)
 	if err != nil {
 		logrus.Errorf("Error encoding output groups: %s", err)
 	}
-	fmt.Print("\n")
+
+	// write the groups to delete, if any, to where they were asked for
+	if len(deletedGroups.Items) > 0 {
+		deletionsFileName := strings.TrimSpace(viper.GetString("deletions"))
+		if len(deletionsFileName) < 1 {
+			logrus.Warnf("%d group(s) should be deleted, use the \"deletions\" option to write them out", len(deletedGroups.Items))
+		} else if deletionsFileName == "-" {
+			err = sync.WriteOpenShiftGroups(deletedGroups, format, os.Stderr)
+		} else {
+			var deletionsFile *os.File
+			deletionsFile, err = os.Create(deletionsFileName)
+			if err == nil {
+				err = sync.WriteOpenShiftGroups(deletedGroups, format, deletionsFile)
+				_ = deletionsFile.Close()
+			}
+		}
+		if err != nil {
+			logrus.Errorf("Error writing groups to delete: %s", err)
+		}
+	}
+
+	finishSync(_EXIT_OK, partial)
+}
+
+/*
+ * finishSync exits with the given code unless optional realms could not be read. then each failure is summarized
+ *            and the exit code shows that the sync was not complete.
+ */
+func finishSync(code int, partial *sync.PartialSyncError) {
+	if partial != nil {
+		for _, failure := range partial.Failures {
+			logrus.Errorf("Realm %s could not be read and its groups were not changed: %s", failure.Realm, failure.Err)
+		}
+		logrus.Errorf("Finished without %d optional realm(s): %s", len(partial.Failures), strings.Join(partial.FailedRealms(), ", "))
+		finish(_EXIT_PARTIAL, partial)
+	}
+	finish(code, nil)
+}
+
+/*
+ * finish records the outcome of a one-shot run, writes the metrics file if one was asked for, and exits
+ */
+func finish(code int, err error) {
+	metrics.ObserveSync(err)
+	metricsFileName := strings.TrimSpace(viper.GetString("metrics-file"))
+	if len(metricsFileName) > 0 {
+		if writeErr := metrics.WriteTextfile(metricsFileName); writeErr != nil {
+			logrus.Errorf("Could not write metrics file: %s", writeErr)
+		}
+	}
+	os.Exit(code)
+}
+
+/*
+ * serve runs the controller until the process is told to stop and returns the exit code
+ */
+func serve(config sync.Config) int {
+	kubeconfig := viper.GetString("kubeconfig")
+	userClient, err := sync.NewOpenShiftClient(kubeconfig)
+	if err != nil {
+		logrus.Errorf("Could not create OpenShift client: %s", err)
+		return _ERROR_CLUSTER_CONNECT
+	}
+	var kubeClient kubernetes.Interface
+	if viper.GetBool("leader-elect") || config.UsesSecretRefs() {
+		kubeClient, err = sync.NewKubernetesClient(kubeconfig)
+		if err != nil {
+			logrus.Errorf("Could not create Kubernetes client: %s", err)
+			return _ERROR_CLUSTER_CONNECT
+		}
+	}
+
+	controller, err := sync.NewController(config, sync.ControllerOptions{
+		Interval:       viper.GetDuration("interval"),
+		Jitter:         viper.GetFloat64("jitter"),
+		Address:        viper.GetString("listen"),
+		LeaderElection: viper.GetBool("leader-elect"),
+		LeaseName:      viper.GetString("lease-name"),
+		LeaseNamespace: viper.GetString("lease-namespace"),
+	}, userClient, kubeClient)
+	if err != nil {
+		logrus.Errorf("Could not create controller: %s", err)
+		return 1
+	}
+
+	// stop on interrupt or terminate
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logrus.Info("Stopping")
+		cancel()
+	}()
+
+	err = controller.Run(ctx)
+	if err != nil {
+		logrus.Errorf("Controller stopped: %s", err)
+		return 1
+	}
+	return _EXIT_OK
 }
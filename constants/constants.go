@@ -5,3 +5,27 @@ const (
 	AnnotationPrimarySource = "keycloak-sync/primary-source"
 	AnnotationRealms        = "keycloak-sync/realms"
 )
+
+const (
+	// the value of the created-by annotation on groups that keycloak-sync creates
+	CreatedByKeycloakSync = "keycloak-sync"
+)
+
+const (
+	// the label that is on every group that keycloak-sync writes so that they can be selected with
+	// "oc get groups -l app.kubernetes.io/managed-by=keycloak-sync"
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// the annotations that keycloak-sync sets all start with this
+	AnnotationPrefix = "keycloak-sync/"
+)
+
+const (
+	// a JSON list of the keycloak groups (or roles) that the group was made from
+	AnnotationSources = "keycloak-sync/sources"
+	// a JSON object of the users that were added from a subgroup to the keycloak path of the subgroup
+	AnnotationUserSources = "keycloak-sync/user-sources"
+	// when the keycloak groups were read, in RFC 3339 format
+	AnnotationSyncedAt = "keycloak-sync/synced-at"
+	// the hash of the users, labels, and annotations that keycloak-sync last wrote to the group
+	AnnotationContentHash = "keycloak-sync/content-hash"
+)
@@ -4,17 +4,24 @@ go 1.14
 
 require (
 	github.com/Nerzal/gocloak/v7 v7.1.0
+	github.com/dgrijalva/jwt-go/v4 v4.0.0-preview1
 	github.com/go-playground/validator/v10 v10.3.0
 	github.com/imdario/mergo v0.3.11 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/openshift/api v0.0.0-20200723134351-89de68875e7c
+	github.com/openshift/client-go v0.0.0-20200722173614-5a1b0aaeff15
 	github.com/openshift/library-go v0.0.0-20200807122248-f5cb4d19a4fe
 	github.com/openshift/oc v4.2.0-alpha.0+incompatible
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/api v0.19.0-rc.2
 	k8s.io/apimachinery v0.19.0-rc.2
+	k8s.io/client-go v0.19.0-rc.2
 	k8s.io/utils v0.0.0-20200731180307-f00132d28269 // indirect
 )
@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const namespace = "keycloak_sync"
+
+// the registry that all keycloak-sync metrics are registered with
+var Registry = prometheus.NewRegistry()
+
+var (
+	realmSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "realm_sync_duration_seconds",
+		Help:      "Time taken to read the groups and users from a realm.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"realm"})
+	realmSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "realm_syncs_total",
+		Help:      "Number of times the groups and users were read from a realm by outcome (success or failure).",
+	}, []string{"realm", "outcome"})
+	realmGroups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realm_groups",
+		Help:      "Number of groups read from a realm in the last successful sync.",
+	}, []string{"realm"})
+	realmUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realm_users",
+		Help:      "Number of distinct users read from a realm in the last successful sync.",
+	}, []string{"realm"})
+	realmLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realm_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful read of a realm.",
+	}, []string{"realm"})
+
+	groupChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "groups_changed_total",
+		Help:      "Number of OpenShift groups changed by action (created, updated, or deleted).",
+	}, []string{"action"})
+	userChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "group_users_changed_total",
+		Help:      "Number of users changed in OpenShift groups by action (added or pruned).",
+	}, []string{"action"})
+
+	groupDrifts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "groups_drifted_total",
+		Help:      "Number of OpenShift groups found changed outside of keycloak-sync since they were last written.",
+	})
+
+	syncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syncs_total",
+		Help:      "Number of complete syncs by outcome (success or failure).",
+	}, []string{"outcome"})
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful complete sync.",
+	})
+
+	keycloakRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keycloak_requests_total",
+		Help:      "Number of requests made to the keycloak api by realm, method, endpoint, and status code.",
+	}, []string{"realm", "method", "endpoint", "code"})
+	keycloakRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "keycloak_request_duration_seconds",
+		Help:      "Latency of requests made to the keycloak api by realm, method, and endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"realm", "method", "endpoint"})
+)
+
+func init() {
+	Registry.MustRegister(
+		realmSyncDuration,
+		realmSyncs,
+		realmGroups,
+		realmUsers,
+		realmLastSuccess,
+		groupChanges,
+		userChanges,
+		groupDrifts,
+		syncs,
+		lastSuccess,
+		keycloakRequests,
+		keycloakRequestDuration,
+	)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+/**
+ * ObserveRealmSync records the time taken and outcome of reading a realm and, when it was successful, the number
+ *                  of groups and users that were read
+ */
+func ObserveRealmSync(realm string, duration time.Duration, err error, groups int, users int) {
+	realmSyncDuration.WithLabelValues(realm).Observe(duration.Seconds())
+	realmSyncs.WithLabelValues(realm, outcome(err)).Inc()
+	if err != nil {
+		return
+	}
+	realmGroups.WithLabelValues(realm).Set(float64(groups))
+	realmUsers.WithLabelValues(realm).Set(float64(users))
+	realmLastSuccess.WithLabelValues(realm).SetToCurrentTime()
+}
+
+/**
+ * ObserveGroupChange records a change to a single OpenShift group and the number of users added and pruned
+ */
+func ObserveGroupChange(action string, added int, pruned int) {
+	groupChanges.WithLabelValues(action).Inc()
+	userChanges.WithLabelValues("added").Add(float64(added))
+	userChanges.WithLabelValues("pruned").Add(float64(pruned))
+}
+
+/**
+ * ObserveGroupDrift records an OpenShift group that was changed outside of keycloak-sync
+ */
+func ObserveGroupDrift() {
+	groupDrifts.Inc()
+}
+
+/**
+ * ObserveSync records the outcome of a complete sync
+ */
+func ObserveSync(err error) {
+	syncs.WithLabelValues(outcome(err)).Inc()
+	if err == nil {
+		lastSuccess.SetToCurrentTime()
+	}
+}
+
+/**
+ * Handler serves the metrics in the Prometheus exposition format
+ */
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+/**
+ * WriteTextfile writes the metrics to a file in the Prometheus text format so that they can be collected by the
+ *               node exporter textfile collector or pushed to a Pushgateway after a one-shot run
+ */
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
+
+/**
+ * InstrumentTransport wraps the transport used for requests to keycloak so that each request is counted and timed
+ */
+func InstrumentTransport(realm string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &instrumentedTransport{
+		realm: realm,
+		next:  next,
+	}
+}
+
+type instrumentedTransport struct {
+	realm string
+	next  http.RoundTripper
+}
+
+func (transport *instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := transport.next.RoundTrip(request)
+
+	endpoint := endpointLabel(request.URL.Path)
+	code := "error"
+	if err == nil && response != nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+	keycloakRequests.WithLabelValues(transport.realm, request.Method, endpoint, code).Inc()
+	keycloakRequestDuration.WithLabelValues(transport.realm, request.Method, endpoint).Observe(time.Since(start).Seconds())
+
+	return response, err
+}
+
+// path segments that are followed by an id that should not be a label value
+var idSegments = map[string]bool{
+	"realms":      true,
+	"groups":      true,
+	"users":       true,
+	"clients":     true,
+	"roles":       true,
+	"roles-by-id": true,
+	"sessions":    true,
+}
+
+/**
+ * endpointLabel turns a request path into an endpoint label without the realm name or ids so that the number of
+ *               label values stays small. "/auth/admin/realms/sso/groups/1234/members" becomes
+ *               "admin/realms/{}/groups/{}/members".
+ */
+func endpointLabel(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	output := make([]string, 0, len(segments))
+	for idx := 0; idx < len(segments); idx++ {
+		segment := segments[idx]
+		// drop the leading "auth" context used by older keycloak versions
+		if idx == 0 && segment == "auth" {
+			continue
+		}
+		output = append(output, segment)
+		if idSegments[segment] && idx+1 < len(segments) {
+			output = append(output, "{}")
+			idx++
+		}
+	}
+	return strings.Join(output, "/")
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointLabel(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("admin/realms/{}/groups/{}/members", endpointLabel("/auth/admin/realms/sso/groups/1234/members"))
+	a.Equal("admin/realms/{}/groups", endpointLabel("/auth/admin/realms/sso/groups"))
+	a.Equal("realms/{}/protocol/openid-connect/token", endpointLabel("/auth/realms/sso/protocol/openid-connect/token"))
+	a.Equal("admin/realms/{}/groups/{}/children", endpointLabel("/admin/realms/sso/groups/1234/children"))
+	a.Equal("admin/realms/{}/users/{}/role-mappings", endpointLabel("/admin/realms/sso/users/abcd/role-mappings"))
+}
+
+func TestInstrumentTransport(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: InstrumentTransport("transport-test", nil)}
+	for _, path := range []string{"/auth/admin/realms/sso/groups", "/auth/admin/realms/sso/groups", "/auth/admin/realms/sso/missing"} {
+		response, err := client.Get(server.URL + path)
+		a.Nil(err)
+		_ = response.Body.Close()
+	}
+
+	a.Equal(2.0, testutil.ToFloat64(keycloakRequests.WithLabelValues("transport-test", http.MethodGet, "admin/realms/{}/groups", "200")))
+	a.Equal(1.0, testutil.ToFloat64(keycloakRequests.WithLabelValues("transport-test", http.MethodGet, "admin/realms/{}/missing", "404")))
+
+	// requests that never get a response are still counted
+	_, err := client.Get("http://127.0.0.1:1/auth/realms/sso")
+	a.NotNil(err)
+	a.Equal(1.0, testutil.ToFloat64(keycloakRequests.WithLabelValues("transport-test", http.MethodGet, "realms/{}", "error")))
+}
+
+func TestObserveRealmSync(t *testing.T) {
+	a := assert.New(t)
+
+	ObserveRealmSync("observe-test", time.Second, nil, 3, 10)
+	a.Equal(3.0, testutil.ToFloat64(realmGroups.WithLabelValues("observe-test")))
+	a.Equal(10.0, testutil.ToFloat64(realmUsers.WithLabelValues("observe-test")))
+
+	// a failure is counted but does not change the last known counts
+	ObserveRealmSync("observe-test", time.Second, errors.New("failed"), 0, 0)
+	a.Equal(3.0, testutil.ToFloat64(realmGroups.WithLabelValues("observe-test")))
+	a.Equal(1.0, testutil.ToFloat64(realmSyncs.WithLabelValues("observe-test", "success")))
+	a.Equal(1.0, testutil.ToFloat64(realmSyncs.WithLabelValues("observe-test", "failure")))
+}
+
+func TestWriteTextfile(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keycloak-sync-metrics")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ObserveGroupChange("created", 2, 0)
+	ObserveSync(nil)
+
+	path := filepath.Join(dir, "keycloak-sync.prom")
+	a.Nil(WriteTextfile(path))
+	content, err := ioutil.ReadFile(path)
+	a.Nil(err)
+	a.Contains(string(content), `keycloak_sync_groups_changed_total{action="created"}`)
+	a.Contains(string(content), `keycloak_sync_syncs_total{outcome="success"}`)
+	a.Contains(string(content), "keycloak_sync_last_success_timestamp_seconds")
+}
@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+/**
+ * firstAttribute returns the first value of the keycloak attribute and true if the attribute is set
+ */
+func firstAttribute(attributes *map[string][]string, name string) (string, bool) {
+	if attributes == nil {
+		return "", false
+	}
+	values, found := (*attributes)[name]
+	if !found || len(values) < 1 {
+		return "", false
+	}
+	return values[0], true
+}
+
+/**
+ * applyGroupAttributes sets the alias and prefix of the group from the keycloak attributes of the group. the name
+ *                      attribute takes precedence over the aliases in the configuration and the prefix attribute
+ *                      replaces the group prefix of the realm, even when it is empty.
+ */
+func applyGroupAttributes(realm RealmConfig, group *Group, attributes *map[string][]string) {
+	if !realm.GroupAttributes.Enabled {
+		return
+	}
+	if name, found := firstAttribute(attributes, realm.GroupAttributes.GetNameAttribute()); found && len(strings.TrimSpace(name)) > 0 {
+		group.Alias = strings.TrimSpace(name)
+	}
+	if prefix, found := firstAttribute(attributes, realm.GroupAttributes.GetPrefixAttribute()); found {
+		group.Prefix = prefix
+	}
+}
+
+/**
+ * attributeSelected returns if the group is selected by the sync attribute and true when the attribute decides.
+ *                   a group without the attribute (or with a value that is not a boolean) is only decided when
+ *                   the attribute is required and then it is not selected.
+ */
+func attributeSelected(realm RealmConfig, group *Group, attributes *map[string][]string) (bool, bool) {
+	if !realm.GroupAttributes.Enabled {
+		return false, false
+	}
+	syncAttribute := realm.GroupAttributes.GetSyncAttribute()
+	if value, found := firstAttribute(attributes, syncAttribute); found {
+		selected, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err == nil {
+			return selected, true
+		}
+		logrus.Warnf("realm %s | group %s has the value %q for attribute %s which is not true or false", realm.Name, group.Path, value, syncAttribute)
+	}
+	if realm.GroupAttributes.Required {
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"context"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func attributedGroup(name string, parentPath string, attributes map[string][]string, subGroups ...gocloak.Group) gocloak.Group {
+	group := fakeGroup(name, parentPath, subGroups...)
+	group.Attributes = &attributes
+	return group
+}
+
+func TestAttributeSelected(t *testing.T) {
+	a := assert.New(t)
+
+	realm := RealmConfig{Name: "sso"}
+	group := Group{Name: "ops", Path: "/ops"}
+	tagged := map[string][]string{"openshift-sync": {"true"}}
+	untagged := map[string][]string{"openshift-sync": {"false"}}
+	invalid := map[string][]string{"openshift-sync": {"maybe"}}
+
+	// nothing is decided unless the attributes are enabled
+	_, decided := attributeSelected(realm, &group, &tagged)
+	a.False(decided)
+
+	realm.GroupAttributes.Enabled = true
+	selected, decided := attributeSelected(realm, &group, &tagged)
+	a.True(decided)
+	a.True(selected)
+	selected, decided = attributeSelected(realm, &group, &untagged)
+	a.True(decided)
+	a.False(selected)
+	_, decided = attributeSelected(realm, &group, &invalid)
+	a.False(decided)
+	_, decided = attributeSelected(realm, &group, nil)
+	a.False(decided)
+
+	// groups without the attribute are not selected when it is required
+	realm.GroupAttributes.Required = true
+	selected, decided = attributeSelected(realm, &group, nil)
+	a.True(decided)
+	a.False(selected)
+	selected, decided = attributeSelected(realm, &group, &invalid)
+	a.True(decided)
+	a.False(selected)
+
+	// the attribute name can be changed
+	realm.GroupAttributes.Sync = "ocp"
+	selected, _ = attributeSelected(realm, &group, &tagged)
+	a.False(selected)
+	selected, _ = attributeSelected(realm, &group, &map[string][]string{"ocp": {"TRUE"}})
+	a.True(selected)
+}
+
+func TestGetGroupsAndUsersForRealmGroupAttributes(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	platform := attributedGroup("platform", "", map[string][]string{"openshift-sync": {"true"}, "openshift-name": {"platform-admins"}},
+		attributedGroup("db", "/platform", map[string][]string{"openshift-sync": {"true"}, "openshift-prefix": {"team-"}}),
+		fakeGroup("interns", "/platform"),
+	)
+	legacy := attributedGroup("legacy", "", map[string][]string{"openshift-sync": {"false"}})
+	untagged := fakeGroup("untagged", "")
+	fake.groups = append(fake.groups, &platform, &legacy, &untagged)
+
+	realm := fake.realmConfig()
+	realm.Subgroups = true
+	realm.GroupPrefix = "sso-"
+	realm.Aliases = map[string]string{"platform": "from-config", "untagged": "everyone"}
+	realm.GroupAttributes.Enabled = true
+
+	names := func() []string {
+		session := newKeycloakSession(realm)
+		defer session.close()
+		groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+		a.Nil(err)
+		found := make([]string, 0)
+		for name := range groups {
+			found = append(found, name)
+		}
+		return found
+	}
+
+	// the attributes name and select groups and groups without them use the configuration
+	a.ElementsMatch([]string{"platform-admins", "team-db", "sso-interns", "everyone"}, names())
+
+	// only tagged groups are synchronized when the attribute is required
+	realm.GroupAttributes.Required = true
+	a.ElementsMatch([]string{"platform-admins", "team-db"}, names())
+
+	// the attributes are ignored unless they are enabled
+	realm.GroupAttributes.Enabled = false
+	a.ElementsMatch([]string{"from-config", "sso-db", "sso-interns", "sso-legacy", "everyone"}, names())
+}
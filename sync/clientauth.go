@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/Nerzal/gocloak/v7/pkg/jwx"
+	"github.com/dgrijalva/jwt-go/v4"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the client assertion type for a signed JWT (RFC 7523)
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// how long a signed JWT can be used, it is only used for a single request
+const clientAssertionLifetime = time.Minute
+
+/**
+ * realmUrl returns the url of the realm which is the issuer of its tokens and the audience of client assertions
+ */
+func realmUrl(realm RealmConfig) string {
+	return strings.TrimRight(realm.Url, "/") + "/auth/realms/" + url.PathEscape(realm.Name)
+}
+
+/**
+ * signingKey reads the private key of the client and returns it with the method used to sign with it. the method
+ *            is RS256 for RSA keys and ES256 for EC keys unless the configuration chooses an algorithm.
+ */
+func signingKey(client ClientConfig) (interface{}, jwt.SigningMethod, error) {
+	data, err := ioutil.ReadFile(client.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the client key: %s", err)
+	}
+
+	var key interface{}
+	algorithm := client.Algorithm
+	if rsaKey, rsaErr := jwt.ParseRSAPrivateKeyFromPEM(data); rsaErr == nil {
+		key = rsaKey
+		if len(algorithm) < 1 {
+			algorithm = "RS256"
+		}
+	} else if ecKey, ecErr := jwt.ParseECPrivateKeyFromPEM(data); ecErr == nil {
+		key = ecKey
+		if len(algorithm) < 1 {
+			algorithm = "ES256"
+		}
+	} else {
+		return nil, nil, fmt.Errorf("the client key in %s is not a PEM encoded RSA or EC private key", client.KeyFile)
+	}
+
+	method := jwt.GetSigningMethod(algorithm)
+	if method == nil {
+		return nil, nil, fmt.Errorf("unknown signing algorithm %s", algorithm)
+	}
+	return key, method, nil
+}
+
+/**
+ * clientAssertion returns a new JWT signed with the private key of the client that keycloak accepts in place of
+ *                 the client secret
+ */
+func clientAssertion(realm RealmConfig) (string, error) {
+	client := realm.ClientConfig
+	key, method, err := signingKey(*client)
+	if err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		ID:        hex.EncodeToString(id),
+		Issuer:    client.ClientId,
+		Subject:   client.ClientId,
+		Audience:  jwt.ClaimStrings{realmUrl(realm)},
+		IssuedAt:  jwt.At(now),
+		ExpiresAt: jwt.At(now.Add(clientAssertionLifetime)),
+	}
+	return jwx.SignClaims(claims, key, method)
+}
+
+/**
+ * clientCredentials returns the token options that authenticate the client when it does not use a secret
+ */
+func clientCredentials(realm RealmConfig, grantType string) (gocloak.TokenOptions, error) {
+	options := gocloak.TokenOptions{
+		ClientID:  gocloak.StringP(realm.ClientConfig.ClientId),
+		GrantType: gocloak.StringP(grantType),
+	}
+	switch realm.ClientConfig.AuthMethod() {
+	case ClientAuthSignedJWT:
+		assertion, err := clientAssertion(realm)
+		if err != nil {
+			return options, err
+		}
+		options.ClientAssertionType = gocloak.StringP(clientAssertionType)
+		options.ClientAssertion = &assertion
+	case ClientAuthX509:
+		// the client certificate is presented when the tls connection is made
+		if len(realm.TLS.CertFile) < 1 {
+			return options, errors.New("x509 client authentication needs the tls cert-file and key-file of the realm")
+		}
+	default:
+		return options, errors.New("the client uses a secret")
+	}
+	return options, nil
+}
+
+/**
+ * loginClientWithoutSecret logs in with the client credentials grant using a signed JWT or the client certificate
+ */
+func loginClientWithoutSecret(ctx context.Context, client gocloak.GoCloak, realm RealmConfig) (*gocloak.JWT, error) {
+	options, err := clientCredentials(realm, "client_credentials")
+	if err != nil {
+		return nil, err
+	}
+	return client.GetToken(ctx, realm.Name, options)
+}
+
+/**
+ * refreshClientWithoutSecret refreshes the token of a client that uses a signed JWT or the client certificate
+ */
+func refreshClientWithoutSecret(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, refreshToken string) (*gocloak.JWT, error) {
+	options, err := clientCredentials(realm, "refresh_token")
+	if err != nil {
+		return nil, err
+	}
+	options.RefreshToken = &refreshToken
+	return client.GetToken(ctx, realm.Name, options)
+}
+
+/**
+ * logoutClientWithoutSecret ends the session of a client that uses a signed JWT or the client certificate
+ */
+func logoutClientWithoutSecret(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, refreshToken string) error {
+	form := map[string]string{
+		"client_id":     realm.ClientConfig.ClientId,
+		"refresh_token": refreshToken,
+	}
+	if realm.ClientConfig.AuthMethod() == ClientAuthSignedJWT {
+		assertion, err := clientAssertion(realm)
+		if err != nil {
+			return err
+		}
+		form["client_assertion_type"] = clientAssertionType
+		form["client_assertion"] = assertion
+	}
+	resp, err := client.RestyClient().R().
+		SetContext(ctx).
+		SetFormData(form).
+		Post(realmUrl(realm) + "/protocol/openid-connect/logout")
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("could not logout: %s", resp.Status())
+	}
+	return nil
+}
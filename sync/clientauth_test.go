@@ -0,0 +1,212 @@
+package sync
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go/v4"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * writeClientKey writes the private key to a PEM file and returns the path to it
+ */
+func writeClientKey(t *testing.T, key crypto.Signer) string {
+	dir, err := ioutil.TempDir("", "keycloak-sync-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	var block *pem.Block
+	switch private := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+	path := filepath.Join(dir, "client-key.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/**
+ * checkAssertion validates the signed JWT in a token request the way keycloak does for a client with the given
+ *                public key
+ */
+func checkAssertion(fake *fakeKeycloak, clientId string, publicKey crypto.PublicKey) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		if r.Form.Get("client_id") != clientId {
+			return fmt.Errorf("unexpected client %s", r.Form.Get("client_id"))
+		}
+		if len(r.Header.Get("Authorization")) > 0 || len(r.Form.Get("client_secret")) > 0 {
+			return errors.New("a client secret was sent")
+		}
+		if r.Form.Get("client_assertion_type") != clientAssertionType {
+			return fmt.Errorf("unexpected assertion type %s", r.Form.Get("client_assertion_type"))
+		}
+		audience := fake.server.URL + "/auth/realms/" + fake.realm
+		token, err := jwt.Parse(r.Form.Get("client_assertion"), func(token *jwt.Token) (interface{}, error) {
+			return publicKey, nil
+		}, jwt.WithAudience(audience))
+		if err != nil {
+			return err
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if claims["iss"] != clientId || claims["sub"] != clientId || claims["jti"] == nil || claims["exp"] == nil {
+			return fmt.Errorf("unexpected claims %v", claims)
+		}
+		return nil
+	}
+}
+
+func signedJWTRealm(fake *fakeKeycloak, keyFile string) RealmConfig {
+	realm := fake.realmConfig()
+	realm.ClientConfig = &ClientConfig{ClientId: "client", KeyFile: keyFile}
+	return realm
+}
+
+func TestSignedJWTLogin(t *testing.T) {
+	a := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.Nil(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.Nil(err)
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		fake := newFakeKeycloak(t)
+		group := fakeGroup("developers", "")
+		fake.groups = append(fake.groups, &group)
+		fake.members[*group.ID] = fakeUsers("dev", 2)
+		fake.tokenCheck = checkAssertion(fake, "client", key.Public())
+
+		session := newKeycloakSession(signedJWTRealm(fake, writeClientKey(t, key)))
+		groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+		session.close()
+		a.Nil(err)
+		a.Len(groups["developers"].Users, 2)
+		// there is no client secret to introspect the token with
+		a.Equal(0, fake.count("introspect"))
+	}
+
+	// a key that keycloak does not know is rejected
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.Nil(err)
+	fake := newFakeKeycloak(t)
+	fake.tokenCheck = checkAssertion(fake, "client", ecKey.Public())
+	session := newKeycloakSession(signedJWTRealm(fake, writeClientKey(t, otherKey)))
+	defer session.close()
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Error(err)
+	a.Equal(0, fake.count("groups"))
+}
+
+func TestSignedJWTAlgorithm(t *testing.T) {
+	a := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.Nil(err)
+	keyFile := writeClientKey(t, rsaKey)
+
+	_, method, err := signingKey(ClientConfig{KeyFile: keyFile})
+	a.Nil(err)
+	a.Equal("RS256", method.Alg())
+	_, method, err = signingKey(ClientConfig{KeyFile: keyFile, Algorithm: "PS384"})
+	a.Nil(err)
+	a.Equal("PS384", method.Alg())
+
+	_, _, err = signingKey(ClientConfig{KeyFile: keyFile + ".missing"})
+	a.Error(err)
+	a.Contains(err.Error(), "could not read the client key")
+}
+
+func TestX509ClientLogin(t *testing.T) {
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+	fake := newUnstartedFakeKeycloak(t)
+	fake.server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pki.pool,
+	}
+	fake.server.StartTLS()
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	fake.members[*group.ID] = fakeUsers("dev", 1)
+	fake.tokenCheck = func(r *http.Request) error {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) < 1 || r.TLS.PeerCertificates[0].Subject.CommonName != "client" {
+			return errors.New("no client certificate")
+		}
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		if len(r.Header.Get("Authorization")) > 0 || len(r.Form.Get("client_secret")) > 0 {
+			return errors.New("a client secret was sent")
+		}
+		return nil
+	}
+
+	realm := fake.realmConfig()
+	realm.TLS = TLSConfig{
+		CAFile:   pki.path("ca.pem"),
+		CertFile: pki.path("client.pem"),
+		KeyFile:  pki.path("client-key.pem"),
+	}
+	realm.ClientConfig = &ClientConfig{ClientId: "client", X509: true}
+	session := newKeycloakSession(realm)
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	session.close()
+	a.Nil(err)
+	a.Len(groups["developers"].Users, 1)
+
+	// the certificate is needed to authenticate the client
+	withoutCertificate := realm
+	withoutCertificate.TLS.CertFile = ""
+	withoutCertificate.TLS.KeyFile = ""
+	session = newKeycloakSession(withoutCertificate)
+	defer session.close()
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Error(err)
+	a.Contains(err.Error(), "x509 client authentication needs")
+}
+
+func TestClientAuthConfig(t *testing.T) {
+	a := assert.New(t)
+
+	config := loadTestConfig("client_auth.yml", t)
+	a.Equal(ClientAuthSignedJWT, config.Realms[0].ClientConfig.AuthMethod())
+	a.Equal("ES256", config.Realms[0].ClientConfig.Algorithm)
+	a.Equal(ClientAuthX509, config.Realms[1].ClientConfig.AuthMethod())
+	a.Equal(ClientAuthSecret, config.Realms[2].ClientConfig.AuthMethod())
+
+	_, err := loadTestConfigWithError("client_auth_conflict.yml", t)
+	a.Error(err)
+	a.Contains(err.Error(), "one_auth_method")
+
+	_, err = loadTestConfigWithError("client_auth_missing.yml", t)
+	a.Error(err)
+}
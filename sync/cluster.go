@@ -0,0 +1,246 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
+	userapi "github.com/openshift/api/user/v1"
+	userclient "github.com/openshift/client-go/user/clientset/versioned"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"sort"
+	"strings"
+)
+
+/**
+ * ApplyResult records the names of the groups that were changed in the cluster by ApplyOpenShiftGroups
+ */
+type ApplyResult struct {
+	Created []string
+	Updated []string
+	Deleted []string
+	Failed  []string
+}
+
+/**
+ * NewOpenShiftClient creates a client for the OpenShift user api. if a kubeconfig path is given then it is used,
+ *                    otherwise the service account is used when running in a pod and the default kubeconfig
+ *                    loading rules (KUBECONFIG, ~/.kube/config) are used when not.
+ */
+func NewOpenShiftClient(kubeconfig string) (userclient.Interface, error) {
+	restConfig, err := getRestConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return userclient.NewForConfig(restConfig)
+}
+
+/**
+ * NewKubernetesClient creates a client for the core Kubernetes apis in the same way as NewOpenShiftClient
+ */
+func NewKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	restConfig, err := getRestConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+func getRestConfig(kubeconfig string) (*rest.Config, error) {
+	if len(strings.TrimSpace(kubeconfig)) > 0 {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	restConfig, err := rest.InClusterConfig()
+	if err == rest.ErrNotInCluster {
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+	return restConfig, err
+}
+
+/**
+ * GetOpenShiftGroupsFromCluster lists the groups that are currently in the cluster
+ */
+func GetOpenShiftGroupsFromCluster(ctx context.Context, client userclient.Interface) (userapi.GroupList, error) {
+	groups, err := client.UserV1().Groups().List(ctx, v1.ListOptions{})
+	if err != nil {
+		return userapi.GroupList{}, err
+	}
+	if groups == nil {
+		return userapi.GroupList{}, fmt.Errorf("a nil response not expected for groups from the cluster")
+	}
+	return *groups, nil
+}
+
+/**
+ * ApplyOpenShiftGroups brings the cluster in line with the desired groups. groups that do not exist in the
+ *                      existing list are created, groups that do exist are updated in place so that any labels
+ *                      or annotations that keycloak-sync does not manage are kept, and groups named in the
+ *                      deletions are deleted. a failure on one group does not stop the others from being applied.
+ *                      nothing more is applied once the context is done, for example when the controller is no
+ *                      longer the leader, and the groups that were not applied are not counted as failed.
+ */
+func ApplyOpenShiftGroups(ctx context.Context, client userclient.Interface, existing userapi.GroupList, desired userapi.GroupList, deletions []string) (ApplyResult, error) {
+	result := ApplyResult{
+		Created: []string{},
+		Updated: []string{},
+		Deleted: []string{},
+		Failed:  []string{},
+	}
+
+	groupClient := client.UserV1().Groups()
+
+	// index existing groups by name
+	existingGroups := make(map[string]userapi.Group)
+	for _, group := range existing.Items {
+		existingGroups[group.Name] = group
+	}
+
+	for _, desiredGroup := range desired.Items {
+		if ctx.Err() != nil {
+			return result, fmt.Errorf("stopped applying groups: %s", ctx.Err())
+		}
+		desiredGroup := desiredGroup
+		if _, found := existingGroups[desiredGroup.Name]; !found {
+			_, err := groupClient.Create(ctx, &desiredGroup, v1.CreateOptions{})
+			if err != nil {
+				logrus.Errorf("could not create group %s: %s", desiredGroup.Name, err)
+				result.Failed = append(result.Failed, desiredGroup.Name)
+				continue
+			}
+			logrus.Infof("group %s created", desiredGroup.Name)
+			result.Created = append(result.Created, desiredGroup.Name)
+			metrics.ObserveGroupChange(DiffCreated, len(desiredGroup.Users), 0)
+			continue
+		}
+
+		// update the group, getting a fresh copy if the group was changed since the list was made
+		current := existingGroups[desiredGroup.Name]
+		var added, pruned []string
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			added, pruned = compareUsers(sortedUsers(current.Users), sortedUsers(desiredGroup.Users))
+			updated := current.DeepCopy()
+			updated.Users = desiredGroup.Users
+			labels := updated.GetLabels()
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			for key, value := range desiredGroup.GetLabels() {
+				labels[key] = value
+			}
+			updated.SetLabels(labels)
+			annotations := updated.GetAnnotations()
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			for _, key := range provenanceKeys {
+				delete(annotations, key)
+			}
+			for key, value := range desiredGroup.GetAnnotations() {
+				annotations[key] = value
+			}
+			updated.SetAnnotations(annotations)
+
+			_, err := groupClient.Update(ctx, updated, v1.UpdateOptions{})
+			if errors.IsConflict(err) {
+				latest, getErr := groupClient.Get(ctx, desiredGroup.Name, v1.GetOptions{})
+				if getErr != nil {
+					return getErr
+				}
+				current = *latest
+			}
+			return err
+		})
+		if err != nil {
+			logrus.Errorf("could not update group %s: %s", desiredGroup.Name, err)
+			result.Failed = append(result.Failed, desiredGroup.Name)
+			continue
+		}
+		logrus.Infof("group %s updated", desiredGroup.Name)
+		result.Updated = append(result.Updated, desiredGroup.Name)
+		metrics.ObserveGroupChange(DiffUpdated, len(added), len(pruned))
+	}
+
+	for _, groupName := range deletions {
+		if ctx.Err() != nil {
+			return result, fmt.Errorf("stopped applying groups: %s", ctx.Err())
+		}
+		pruned := 0
+		if group, found := existingGroups[groupName]; found {
+			pruned = len(group.Users)
+		}
+		err := groupClient.Delete(ctx, groupName, v1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("could not delete group %s: %s", groupName, err)
+			result.Failed = append(result.Failed, groupName)
+			continue
+		}
+		logrus.Infof("group %s deleted", groupName)
+		result.Deleted = append(result.Deleted, groupName)
+		metrics.ObserveGroupChange(DiffDeleted, 0, pruned)
+	}
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("could not apply %d group(s): %s", len(result.Failed), strings.Join(result.Failed, ", "))
+	}
+
+	return result, nil
+}
+
+/**
+ * Reconcile reads the groups from the cluster and keycloak, merges them, and applies the result to the cluster
+ *           using the same steps as the command line. the keycloak sessions are kept open between calls. when only
+ *           optional realms failed the other realms are still applied and the PartialSyncError is returned. the
+ *           cluster is not changed after the context is done.
+ */
+func Reconcile(ctx context.Context, config Config, sessions *KeycloakSessions, client userclient.Interface) (ApplyResult, error) {
+	clusterGroups, err := GetOpenShiftGroupsFromCluster(ctx, client)
+	if err != nil {
+		return ApplyResult{}, err
+	}
+
+	keycloakGroups, err := sessions.GetKeycloakGroups(ctx, config)
+	partial, isPartial := AsPartialSync(err)
+	if err != nil && !isPartial {
+		return ApplyResult{}, err
+	}
+
+	openshiftGroups, keycloakGroups, err := ResolveCollisions(config, FromOpenShiftGroups(config, clusterGroups), keycloakGroups)
+	if err != nil {
+		return ApplyResult{}, err
+	}
+	if isPartial {
+		openshiftGroups = KeepFailedRealmGroups(openshiftGroups, partial.FailedRealms())
+	}
+
+	finalGroups := Merge(openshiftGroups, keycloakGroups)
+	deletions := make([]string, 0)
+	for _, group := range finalGroups.ToOpenShiftGroupDeletions(config).Items {
+		deletions = append(deletions, group.Name)
+	}
+
+	// the groups in the cluster may have been changed by another leader while keycloak was read
+	if ctx.Err() != nil {
+		return ApplyResult{}, fmt.Errorf("stopped before applying groups: %s", ctx.Err())
+	}
+
+	result, err := ApplyOpenShiftGroups(ctx, client, clusterGroups, finalGroups.WithSyncedAt(finalGroups.ToOpenShiftGroups(config, true)), deletions)
+	if err == nil && isPartial {
+		return result, partial
+	}
+	return result, err
+}
+
+func sortedUsers(users userapi.OptionalNames) []string {
+	sorted := make([]string, 0, len(users))
+	sorted = append(sorted, users...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"context"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userapi "github.com/openshift/api/user/v1"
+	"github.com/openshift/client-go/user/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+	"sort"
+	"testing"
+	"time"
+)
+
+func clusterGroup(name string, annotations map[string]string, users ...string) *userapi.Group {
+	return &userapi.Group{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+			Labels:      map[string]string{"team": "platform"},
+		},
+		Users: users,
+	}
+}
+
+func TestApplyOpenShiftGroups(t *testing.T) {
+	a := assert.New(t)
+
+	client := fake.NewSimpleClientset(
+		clusterGroup("developers", map[string]string{"owner": "someone", constants.AnnotationCreatedBy: constants.CreatedByKeycloakSync}, "test1", "test4"),
+		clusterGroup("stale", nil, "test1"),
+	)
+	existing, err := GetOpenShiftGroupsFromCluster(context.Background(), client)
+	a.Nil(err)
+	a.Equal(2, len(existing.Items))
+
+	config := Config{Prune: true}
+	keycloakGroups := GroupList{
+		"developers": Group{Name: "developers", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test1": {Name: "test1"},
+			"test2": {Name: "test2"},
+		}},
+		"admins": Group{Name: "admins", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test3": {Name: "test3"},
+		}},
+	}
+	finalGroups := Merge(FromOpenShiftGroups(config, existing), keycloakGroups)
+	desired := finalGroups.ToOpenShiftGroups(config, true)
+
+	result, err := ApplyOpenShiftGroups(context.Background(), client, existing, desired, []string{"stale", "already-gone"})
+	a.Nil(err)
+	a.Equal([]string{"admins"}, result.Created)
+	a.Equal([]string{"stale"}, result.Deleted)
+	a.Empty(result.Failed)
+	a.Contains(result.Updated, "developers")
+
+	// the created group exists
+	admins, err := client.UserV1().Groups().Get(context.Background(), "admins", v1.GetOptions{})
+	a.Nil(err)
+	a.Equal(userapi.OptionalNames{"test3"}, admins.Users)
+
+	// the updated group has pruned users and keeps unmanaged metadata
+	developers, err := client.UserV1().Groups().Get(context.Background(), "developers", v1.GetOptions{})
+	a.Nil(err)
+	users := []string(developers.Users)
+	sort.Strings(users)
+	a.Equal([]string{"test1", "test2"}, users)
+	a.Equal("someone", developers.Annotations["owner"])
+	a.Equal("keycloak-sync", developers.Annotations[constants.AnnotationCreatedBy])
+	a.Equal("platform", developers.Labels["team"])
+
+	// the deleted group is gone
+	remaining, err := GetOpenShiftGroupsFromCluster(context.Background(), client)
+	a.Nil(err)
+	a.Equal(2, len(remaining.Items))
+}
+
+func TestApplyStopsWhenCancelled(t *testing.T) {
+	a := assert.New(t)
+
+	// the context is cancelled while the first group is created, as when the lease is lost during a reconcile
+	client := fake.NewSimpleClientset(clusterGroup("stale", nil, "test1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.PrependReactor("create", "groups", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		cancel()
+		return false, nil, nil
+	})
+
+	desired := userapi.GroupList{Items: []userapi.Group{*clusterGroup("admins", nil, "test1"), *clusterGroup("developers", nil, "test2")}}
+	result, err := ApplyOpenShiftGroups(ctx, client, userapi.GroupList{}, desired, []string{"stale"})
+	a.Error(err)
+	a.Contains(err.Error(), "stopped applying groups")
+	a.Equal([]string{"admins"}, result.Created)
+	a.Empty(result.Deleted)
+
+	// nothing after the cancel is applied
+	remaining, err := GetOpenShiftGroupsFromCluster(context.Background(), client)
+	a.Nil(err)
+	names := make([]string, 0)
+	for _, group := range remaining.Items {
+		names = append(names, group.Name)
+	}
+	a.ElementsMatch([]string{"admins", "stale"}, names)
+}
+
+func TestReconcileStopsReadingWhenCancelled(t *testing.T) {
+	a := assert.New(t)
+
+	// the members take much longer than the test to answer and the lease is lost while they are read
+	keycloak, config := controllerTestConfig(t)
+	keycloak.membersDelay = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitFor(t, func() bool { return keycloak.count("members") > 0 })
+		cancel()
+	}()
+
+	sessions := NewKeycloakSessions()
+	defer sessions.Close()
+	client := fake.NewSimpleClientset()
+	start := time.Now()
+	_, err := Reconcile(ctx, config, sessions, client)
+	a.Error(err)
+	a.True(time.Since(start) < 30*time.Second)
+
+	// nothing was applied
+	groups, err := GetOpenShiftGroupsFromCluster(context.Background(), client)
+	a.Nil(err)
+	a.Empty(groups.Items)
+}
@@ -3,44 +3,499 @@ package sync
 import (
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
+	"regexp"
+	"strings"
+	"time"
 )
 
+/**
+ * SecretKeyRef points to a key in a Kubernetes Secret. the namespace is the namespace of the pod when it is not
+ *              given.
+ */
+type SecretKeyRef struct {
+	Namespace string `mapstructure:"namespace"`
+	Name      string `mapstructure:"name" validate:"required"`
+	Key       string `mapstructure:"key" validate:"required"`
+}
+
+/**
+ * ClientConfig logs in as a confidential client with exactly one of a client secret, a signed JWT made with the
+ *              private key in the key file (private_key_jwt), or the client certificate from the tls settings of
+ *              the realm (x509). the client secret is given in the configuration (where ${ENV} references are
+ *              replaced with environment variables), read from a file, or read from a Kubernetes Secret.
+ */
 type ClientConfig struct {
-	ClientId     string `mapstructure:"id" validate:"required"`
-	ClientSecret string `mapstructure:"secret" validate:"required"`
+	ClientId     string        `mapstructure:"id" validate:"required"`
+	ClientSecret string        `mapstructure:"secret" validate:"required_without_all=SecretFile SecretRef KeyFile X509"`
+	SecretFile   string        `mapstructure:"secret-file"`
+	SecretRef    *SecretKeyRef `mapstructure:"secret-ref"`
+	// a PEM encoded RSA or EC private key and the algorithm used to sign the JWT with it
+	KeyFile   string `mapstructure:"key-file"`
+	Algorithm string `mapstructure:"algorithm" validate:"omitempty,oneof=RS256 RS384 RS512 PS256 PS384 PS512 ES256 ES384 ES512"`
+	X509      bool   `mapstructure:"x509"`
+}
+
+const (
+	ClientAuthSecret    = "secret"
+	ClientAuthSignedJWT = "signed-jwt"
+	ClientAuthX509      = "x509"
+)
+
+/**
+ * AuthMethod returns how the client authenticates to keycloak
+ */
+func (client ClientConfig) AuthMethod() string {
+	if len(client.KeyFile) > 0 {
+		return ClientAuthSignedJWT
+	}
+	if client.X509 {
+		return ClientAuthX509
+	}
+	return ClientAuthSecret
 }
 
+// validateClientConfig is a struct validation that only allows one way for a client to authenticate and one source
+// for the client secret
+func validateClientConfig(level validator.StructLevel) {
+	client := level.Current().Interface().(ClientConfig)
+	methods := 0
+	for _, set := range []bool{len(client.ClientSecret) > 0, len(client.SecretFile) > 0, client.SecretRef != nil, len(client.KeyFile) > 0, client.X509} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		level.ReportError(client.ClientSecret, "ClientSecret", "secret", "one_auth_method", "")
+	}
+}
+
+/**
+ * UserConfig logs in as a user through the admin-cli client. the password is given in the configuration (where
+ *            ${ENV} references are replaced with environment variables), read from a file, or read from a
+ *            Kubernetes Secret.
+ */
 type UserConfig struct {
-	Username string `mapstructure:"username" validate:"required"`
-	Password string `mapstructure:"password" validate:"required"`
+	Username     string        `mapstructure:"username" validate:"required"`
+	Password     string        `mapstructure:"password" validate:"required_without_all=PasswordFile PasswordRef"`
+	PasswordFile string        `mapstructure:"password-file"`
+	PasswordRef  *SecretKeyRef `mapstructure:"password-ref"`
 
 	// optional value if the login realm is different than the target realm
 	LoginRealm string `mapstructure:"realm"`
 }
 
+// validateUserConfig is a struct validation that only allows one source for the password
+func validateUserConfig(level validator.StructLevel) {
+	user := level.Current().Interface().(UserConfig)
+	sources := 0
+	for _, set := range []bool{len(user.Password) > 0, len(user.PasswordFile) > 0, user.PasswordRef != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		level.ReportError(user.Password, "Password", "password", "one_password_source", "")
+	}
+}
+
+/**
+ * RoleConfig selects the keycloak roles that are synchronized as groups. client roles are listed under the
+ *            client id that is shown in keycloak (not the internal id of the client).
+ */
+type RoleConfig struct {
+	Realm   []string            `mapstructure:"realm"`
+	Clients map[string][]string `mapstructure:"clients"`
+}
+
+/**
+ * IsEmpty is true when no roles are selected
+ */
+func (roles RoleConfig) IsEmpty() bool {
+	if len(roles.Realm) > 0 {
+		return false
+	}
+	for _, roleNames := range roles.Clients {
+		if len(roleNames) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * MemberFilterConfig removes users from the groups that are synchronized from a realm. a user that is removed by
+ *                    any of the filters is not added to any group.
+ */
+type MemberFilterConfig struct {
+	SkipDisabled         bool `mapstructure:"skip-disabled"`
+	RequireEmailVerified bool `mapstructure:"require-email-verified"`
+	SkipServiceAccounts  bool `mapstructure:"skip-service-accounts"`
+	// users must match every attribute filter
+	Attributes []AttributeFilterConfig `mapstructure:"attributes" validate:"dive"`
+}
+
+/**
+ * AttributeFilterConfig matches a user when any value of the named attribute is equal to the given value or
+ *                       matches the given regular expression. the name can also be one of the built in fields that
+ *                       can be used for the preferred username (username, email, firstName, lastName, or id).
+ */
+type AttributeFilterConfig struct {
+	Name   string `mapstructure:"name" validate:"required"`
+	Equals string `mapstructure:"equals" validate:"required_without=Regex"`
+	Regex  string `mapstructure:"regex" validate:"omitempty,regexp"`
+}
+
+/**
+ * GroupRuleConfig includes or excludes the groups that match a keycloak path glob (like "/platform/**") or a
+ *                 regular expression. the glob or regex is matched against both the keycloak path of the group and
+ *                 the final name of the group. only one of path or regex can be set.
+ */
+type GroupRuleConfig struct {
+	Action string `mapstructure:"action" validate:"required,oneof=include exclude"`
+	Path   string `mapstructure:"path" validate:"required_without=Regex"`
+	Regex  string `mapstructure:"regex" validate:"omitempty,regexp"`
+}
+
+// validateGroupRuleConfig is a struct validation that only allows one of the path glob or the regex in a rule
+func validateGroupRuleConfig(level validator.StructLevel) {
+	rule := level.Current().Interface().(GroupRuleConfig)
+	if len(rule.Path) > 0 && len(rule.Regex) > 0 {
+		level.ReportError(rule.Regex, "Regex", "regex", "one_pattern", "")
+	}
+}
+
+/**
+ * MetadataConfig is a label or annotation that is set on the OpenShift groups. the value is a template that is
+ *                given the same values as the name template (like {{.Realm}}, {{.ID}}, and {{.Path}}). this is a
+ *                list entry instead of a map because keys like "example.com/team" contain "." which is the key
+ *                separator for the configuration.
+ */
+type MetadataConfig struct {
+	Key   string `mapstructure:"key" validate:"required"`
+	Value string `mapstructure:"value"`
+}
+
+/**
+ * GroupMetadataConfig sets labels and annotations on the groups that match a keycloak path glob. the glob is
+ *                     matched against both the keycloak path and the final name of the group like group rules.
+ */
+type GroupMetadataConfig struct {
+	Path        string           `mapstructure:"path" validate:"required"`
+	Labels      []MetadataConfig `mapstructure:"labels" validate:"dive"`
+	Annotations []MetadataConfig `mapstructure:"annotations" validate:"dive"`
+}
+
+/**
+ * NameRulesConfig normalizes the final names of groups so that they can be used in OpenShift
+ */
+type NameRulesConfig struct {
+	Lowercase bool `mapstructure:"lowercase"`
+	// each run of illegal characters is replaced with the replacement, nothing is replaced if it is empty
+	Replacement       string `mapstructure:"replacement"`
+	IllegalCharacters string `mapstructure:"illegal-characters" validate:"omitempty,regexp"`
+	// longer names are shortened and end with a hash of the name so that they stay unique
+	MaxLength int `mapstructure:"max-length" validate:"omitempty,gte=16"`
+}
+
+/**
+ * TLSConfig configures the TLS connection to keycloak. the CA bundle is added to the system trust store (and
+ *           turns on verification of the server) and the client certificate and key are used for mutual TLS.
+ */
+type TLSConfig struct {
+	CAFile     string `mapstructure:"ca-file"`
+	CertFile   string `mapstructure:"cert-file" validate:"required_with=KeyFile"`
+	KeyFile    string `mapstructure:"key-file" validate:"required_with=CertFile"`
+	MinVersion string `mapstructure:"min-version" validate:"omitempty,oneof=1.0 1.1 1.2 1.3"`
+}
+
+/**
+ * ProxyConfig sends the requests to keycloak through a proxy instead of the proxy from the environment. hosts,
+ *             domains (".example.com"), and CIDR ranges in the no-proxy list are connected to directly.
+ */
+type ProxyConfig struct {
+	Url     string   `mapstructure:"url" validate:"omitempty,url"`
+	NoProxy []string `mapstructure:"no-proxy"`
+}
+
+/**
+ * GroupAttributeConfig lets keycloak administrators select and name groups with group attributes instead of
+ *                      changing the configuration. each option is the name of the keycloak attribute that is read.
+ */
+type GroupAttributeConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// when true only groups with the sync attribute set to true are synchronized
+	Required bool   `mapstructure:"required"`
+	Sync     string `mapstructure:"sync"`
+	Name     string `mapstructure:"name"`
+	Prefix   string `mapstructure:"prefix"`
+}
+
+const (
+	defaultSyncAttribute   = "openshift-sync"
+	defaultNameAttribute   = "openshift-name"
+	defaultPrefixAttribute = "openshift-prefix"
+)
+
+/**
+ * GetSyncAttribute returns the name of the attribute that selects (true) or excludes (false) a group
+ */
+func (attributes GroupAttributeConfig) GetSyncAttribute() string {
+	if len(strings.TrimSpace(attributes.Sync)) < 1 {
+		return defaultSyncAttribute
+	}
+	return attributes.Sync
+}
+
+/**
+ * GetNameAttribute returns the name of the attribute that sets the alias of a group
+ */
+func (attributes GroupAttributeConfig) GetNameAttribute() string {
+	if len(strings.TrimSpace(attributes.Name)) < 1 {
+		return defaultNameAttribute
+	}
+	return attributes.Name
+}
+
+/**
+ * GetPrefixAttribute returns the name of the attribute that replaces the group prefix of the realm for a group
+ */
+func (attributes GroupAttributeConfig) GetPrefixAttribute() string {
+	if len(strings.TrimSpace(attributes.Prefix)) < 1 {
+		return defaultPrefixAttribute
+	}
+	return attributes.Prefix
+}
+
 type RealmConfig struct {
 	Name              string `mapstructure:"name" validate:"required"`
 	Url               string `mapstructure:"url" validate:"required"`
-	*ClientConfig     `mapstructure:"" validate:"required_without=UserConfig"`
-	*UserConfig       `mapstructure:"" validate:"required_without=ClientConfig""`
-	SslVerify         bool              `mapstructure:"ssl-verify"`
-	PreferredUsername []string          `mapstructure:"preferred-username"`
-	Groups            []string          `mapstructure:"groups"`
-	BlockedGroups     []string          `mapstructure:"block-groups"`
-	BlockedNames      []string          `mapstructure:"block-group-names"`
-	GroupPrefix       string            `mapstructure:"group-prefix"`
-	GroupSuffix       string            `mapstructure:"group-suffix"`
-	Aliases           map[string]string `mapstructure:"aliases"`
-	Prune             bool              `mapstructure:"prune"`
-	Subgroups         bool              `mapstructure:"subgroups"`
-	SubgroupUsers     bool              `mapstructure:"subroup-promote-users"`
-	SubgroupConcat    bool              `mapstructure:"subgroup-concat-names"`
-	SubgroupSeparator string            `mapstructure:"subgroup-separator"`
+	*ClientConfig     `mapstructure:"client" validate:"required_without=UserConfig"`
+	*UserConfig       `mapstructure:"user" validate:"required_without=ClientConfig"`
+	SslVerify         bool                  `mapstructure:"ssl-verify"`
+	TLS               TLSConfig             `mapstructure:"tls"`
+	Proxy             ProxyConfig           `mapstructure:"proxy"`
+	PreferredUsername []string              `mapstructure:"preferred-username"`
+	Groups            []string              `mapstructure:"groups"`
+	BlockedGroups     []string              `mapstructure:"block-groups"`
+	BlockedNames      []string              `mapstructure:"block-group-names"`
+	GroupPrefix       string                `mapstructure:"group-prefix"`
+	GroupSuffix       string                `mapstructure:"group-suffix"`
+	Aliases           map[string]string     `mapstructure:"aliases"`
+	Prune             bool                  `mapstructure:"prune"`
+	Subgroups         bool                  `mapstructure:"subgroups"`
+	SubgroupUsers     bool                  `mapstructure:"subroup-promote-users"`
+	SubgroupConcat    bool                  `mapstructure:"subgroup-concat-names"`
+	SubgroupSeparator string                `mapstructure:"subgroup-separator"`
+	PageSize          int                   `mapstructure:"page-size" validate:"gte=0"`
+	Workers           int                   `mapstructure:"workers" validate:"gte=0"`
+	Roles             RoleConfig            `mapstructure:"roles"`
+	MemberFilters     MemberFilterConfig    `mapstructure:"member-filters"`
+	GroupRules        []GroupRuleConfig     `mapstructure:"group-rules" validate:"dive"`
+	NameTemplate      string                `mapstructure:"name-template"`
+	NameRules         NameRulesConfig       `mapstructure:"name-rules"`
+	GroupAttributes   GroupAttributeConfig  `mapstructure:"group-attributes"`
+	Labels            []MetadataConfig      `mapstructure:"labels" validate:"dive"`
+	Annotations       []MetadataConfig      `mapstructure:"annotations" validate:"dive"`
+	GroupMetadata     []GroupMetadataConfig `mapstructure:"group-metadata" validate:"dive"`
+	MergeStrategy     string                `mapstructure:"merge-strategy" validate:"omitempty,oneof=union first-wins priority error"`
+	Priority          int                   `mapstructure:"priority"`
+	// when an optional realm can't be read the other realms are still synchronized
+	Optional bool `mapstructure:"optional"`
+	// limits for the requests made to keycloak
+	RequestTimeout time.Duration `mapstructure:"request-timeout" validate:"gte=0"`
+	Deadline       time.Duration `mapstructure:"deadline" validate:"gte=0"`
+	Retries        int           `mapstructure:"retries" validate:"gte=0"`
+	RetryBackoff   time.Duration `mapstructure:"retry-backoff" validate:"gte=0"`
+	RateLimit      float64       `mapstructure:"rate-limit" validate:"gte=0"`
+	RateBurst      int           `mapstructure:"rate-burst" validate:"gte=0"`
+}
+
+// the default page size matches the keycloak default page size for the admin api
+const defaultPageSize = 100
+
+/**
+ * GetPageSize returns the number of items requested for each page of a paginated keycloak query
+ */
+func (realm RealmConfig) GetPageSize() int {
+	if realm.PageSize < 1 {
+		return defaultPageSize
+	}
+	return realm.PageSize
+}
+
+/**
+ * GetWorkers returns the number of concurrent requests that can be made to keycloak for the members of groups
+ */
+func (realm RealmConfig) GetWorkers() int {
+	if realm.Workers < 1 {
+		return 1
+	}
+	return realm.Workers
+}
+
+/**
+ * GetSubgroupSeparator returns the characters between the name of a group and the names of its children
+ */
+func (realm RealmConfig) GetSubgroupSeparator() string {
+	if len(strings.TrimSpace(realm.SubgroupSeparator)) < 1 {
+		return "."
+	}
+	return realm.SubgroupSeparator
+}
+
+/**
+ * needsGroupAttributes is true when the attributes of each group have to be requested from keycloak. that is when
+ *                      attributes select and name groups, when there is a name template, or when a label or
+ *                      annotation template uses {{.Attributes}} or {{.Attribute "name"}}.
+ */
+func (realm RealmConfig) needsGroupAttributes() bool {
+	if realm.GroupAttributes.Enabled || len(strings.TrimSpace(realm.NameTemplate)) > 0 {
+		return true
+	}
+	metadata := append(append([]MetadataConfig{}, realm.Labels...), realm.Annotations...)
+	for _, groupMetadata := range realm.GroupMetadata {
+		metadata = append(append(metadata, groupMetadata.Labels...), groupMetadata.Annotations...)
+	}
+	for _, entry := range metadata {
+		if strings.Contains(entry.Value, "Attribute") {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// a request that takes longer than this is cancelled unless the realm sets a different timeout
+	defaultRequestTimeout = 30 * time.Second
+	// the wait before the first retry, it doubles for each retry after that
+	defaultRetryBackoff = 500 * time.Millisecond
+)
+
+/**
+ * GetRequestTimeout returns how long a single request to keycloak can take before it is cancelled
+ */
+func (realm RealmConfig) GetRequestTimeout() time.Duration {
+	if realm.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return realm.RequestTimeout
+}
+
+/**
+ * GetRetryBackoff returns the wait before the first retry of a failed read
+ */
+func (realm RealmConfig) GetRetryBackoff() time.Duration {
+	if realm.RetryBackoff <= 0 {
+		return defaultRetryBackoff
+	}
+	return realm.RetryBackoff
+}
+
+/**
+ * GetRateBurst returns the number of requests that can be made at once before the rate limit applies
+ */
+func (realm RealmConfig) GetRateBurst() int {
+	if realm.RateBurst < 1 {
+		return 1
+	}
+	return realm.RateBurst
 }
 
 type Config struct {
-	Realms []RealmConfig `mapstructure:"realms" validate:"dive"`
-	Prune  bool          `mapstructure:"prune"`
+	Realms      []RealmConfig `mapstructure:"realms" validate:"dive"`
+	Prune       bool          `mapstructure:"prune"`
+	PruneGroups bool          `mapstructure:"prune-groups"`
+	Workers     int           `mapstructure:"workers" validate:"gte=0"`
+	Collisions  string        `mapstructure:"collision-policy" validate:"omitempty,oneof=adopt skip fail"`
+	// how groups with the same final name from more than one realm are merged
+	MergeStrategy        string             `mapstructure:"merge-strategy" validate:"omitempty,oneof=union first-wins priority error"`
+	GroupMergeStrategies []GroupMergeConfig `mapstructure:"group-merge-strategies" validate:"dive"`
+}
+
+/**
+ * GroupMergeConfig sets the merge strategy for a single group by its final name. this is a list instead of a map
+ *                  because group names can contain "." which is the key separator for the configuration.
+ */
+type GroupMergeConfig struct {
+	Group    string `mapstructure:"group" validate:"required"`
+	Strategy string `mapstructure:"strategy" validate:"required,oneof=union first-wins priority error"`
+}
+
+const (
+	// the users of every realm are added to the group
+	MergeUnion = "union"
+	// the group from the realm that is listed first is kept
+	MergeFirstWins = "first-wins"
+	// the group from the realm with the highest priority is kept
+	MergePriority = "priority"
+	// the sync stops with an error
+	MergeError = "error"
+)
+
+/**
+ * GetMergeStrategy returns the strategy used when the group with the given final name from the given realm has
+ *                  the same name as a group from a realm that was merged before it. a strategy for the group
+ *                  takes precedence over the strategy of the realm which takes precedence over the global strategy.
+ */
+func (config Config) GetMergeStrategy(realm RealmConfig, groupName string) string {
+	for _, group := range config.GroupMergeStrategies {
+		if group.Group == groupName {
+			return group.Strategy
+		}
+	}
+	if len(realm.MergeStrategy) > 0 {
+		return realm.MergeStrategy
+	}
+	if len(config.MergeStrategy) > 0 {
+		return config.MergeStrategy
+	}
+	return MergeUnion
+}
+
+const (
+	// take over groups that were not created by keycloak-sync
+	CollisionAdopt = "adopt"
+	// leave groups that were not created by keycloak-sync alone and warn
+	CollisionSkip = "skip"
+	// stop when a group that was not created by keycloak-sync would be changed
+	CollisionFail = "fail"
+)
+
+/**
+ * GetCollisionPolicy returns the policy for keycloak groups that have the same name as an OpenShift group that
+ *                    was not created by keycloak-sync
+ */
+func (config Config) GetCollisionPolicy() string {
+	if len(config.Collisions) < 1 {
+		return CollisionSkip
+	}
+	return config.Collisions
+}
+
+/**
+ * GetWorkers returns the number of realms that can be synchronized concurrently
+ */
+func (config Config) GetWorkers() int {
+	if config.Workers < 1 {
+		return 1
+	}
+	return config.Workers
+}
+
+/**
+ * UsesSecretRefs returns true if a realm reads its credentials from a Kubernetes Secret and so needs a client for
+ *                the cluster
+ */
+func (config Config) UsesSecretRefs() bool {
+	for _, realm := range config.Realms {
+		if realm.ClientConfig != nil && realm.ClientConfig.SecretRef != nil {
+			return true
+		}
+		if realm.UserConfig != nil && realm.UserConfig.PasswordRef != nil {
+			return true
+		}
+	}
+	return false
 }
 
 func LoadConfig(path string) (Config, error) {
@@ -57,6 +512,13 @@ func LoadConfig(path string) (Config, error) {
 
 	// now validate configuration and return error if not valid
 	validate := validator.New()
+	err = validate.RegisterValidation("regexp", validateRegexp)
+	if err != nil {
+		return config, err
+	}
+	validate.RegisterStructValidation(validateClientConfig, ClientConfig{})
+	validate.RegisterStructValidation(validateUserConfig, UserConfig{})
+	validate.RegisterStructValidation(validateGroupRuleConfig, GroupRuleConfig{})
 	err = validate.Struct(config)
 	if err != nil {
 		return config, err
@@ -64,3 +526,9 @@ func LoadConfig(path string) (Config, error) {
 
 	return config, nil
 }
+
+// validateRegexp is a custom validation that checks that a string is a valid regular expression
+func validateRegexp(field validator.FieldLevel) bool {
+	_, err := regexp.Compile(field.Field().String())
+	return err == nil
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func loadTestConfigWithError(testFileName string, t *testing.T) (Config, error) {
@@ -54,3 +55,48 @@ func TestEmptyRealmsOk(t *testing.T) {
 	_, err := loadTestConfigWithError("empty_realms_ok.yml", t)
 	a.Nil(err)
 }
+
+func TestMemberFilterConfig(t *testing.T) {
+	a := assert.New(t)
+
+	config := loadTestConfig("member_filters.yml", t)
+	filters := config.Realms[0].MemberFilters
+	a.True(filters.SkipDisabled)
+	a.True(filters.RequireEmailVerified)
+	a.True(filters.SkipServiceAccounts)
+	a.Equal([]AttributeFilterConfig{
+		{Name: "department", Equals: "engineering"},
+		{Name: "email", Regex: "@example\\.com$"},
+	}, filters.Attributes)
+
+	_, err := loadTestConfigWithError("bad_member_filter_regex.yml", t)
+	a.Error(err)
+}
+
+func TestRequestLimitConfig(t *testing.T) {
+	a := assert.New(t)
+
+	config := loadTestConfig("request_limits.yml", t)
+	realm := config.Realms[0]
+	a.Equal(10*time.Second, realm.GetRequestTimeout())
+	a.Equal(5*time.Minute, realm.Deadline)
+	a.Equal(3, realm.Retries)
+	a.Equal(250*time.Millisecond, realm.GetRetryBackoff())
+	a.Equal(2.5, realm.RateLimit)
+	a.Equal(5, realm.GetRateBurst())
+
+	// the defaults
+	realm = RealmConfig{}
+	a.Equal(30*time.Second, realm.GetRequestTimeout())
+	a.Equal(time.Duration(0), realm.Deadline)
+	a.Equal(500*time.Millisecond, realm.GetRetryBackoff())
+	a.Equal(1, realm.GetRateBurst())
+}
+
+func TestGroupRuleOnePattern(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := loadTestConfigWithError("group_rules_two_patterns.yml", t)
+	a.Error(err)
+	a.Contains(err.Error(), "one_pattern")
+}
@@ -0,0 +1,104 @@
+package sync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// the tls versions that can be given as the minimum version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/**
+ * tlsClientConfig returns the tls configuration for the connections to the realm. verification is skipped when
+ *                 ssl-verify is false and there is no CA bundle, otherwise the certificate of the server must be
+ *                 signed by a CA in the system trust store or the configured CA bundle. a CA bundle is only given
+ *                 to verify the server so it turns verification on even when ssl-verify is false.
+ */
+func tlsClientConfig(realm RealmConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: !realm.SslVerify && len(realm.TLS.CAFile) < 1,
+	}
+
+	if len(realm.TLS.MinVersion) > 0 {
+		version, found := tlsVersions[realm.TLS.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown tls version %s", realm.TLS.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(realm.TLS.CAFile) > 0 {
+		bundle, err := ioutil.ReadFile(realm.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in the CA bundle %s", realm.TLS.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(realm.TLS.CertFile) > 0 || len(realm.TLS.KeyFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(realm.TLS.CertFile, realm.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+/**
+ * proxyFunc returns the proxy for each request to the realm. without a configured proxy the proxy comes from the
+ *           HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables the same as before.
+ */
+func proxyFunc(realm RealmConfig) (func(*http.Request) (*url.URL, error), error) {
+	if len(realm.Proxy.Url) < 1 {
+		return http.ProxyFromEnvironment, nil
+	}
+	if _, err := url.Parse(realm.Proxy.Url); err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %s", err)
+	}
+	proxy := httpproxy.Config{
+		HTTPProxy:  realm.Proxy.Url,
+		HTTPSProxy: realm.Proxy.Url,
+		NoProxy:    strings.Join(realm.Proxy.NoProxy, ","),
+	}
+	forURL := proxy.ProxyFunc()
+	return func(request *http.Request) (*url.URL, error) {
+		return forURL(request.URL)
+	}, nil
+}
+
+/**
+ * configureTransport applies the tls and proxy configuration of the realm to the transport
+ */
+func configureTransport(realm RealmConfig, transport *http.Transport) error {
+	tlsConfig, err := tlsClientConfig(realm)
+	if err != nil {
+		return fmt.Errorf("realm %s: %s", realm.Name, err)
+	}
+	proxy, err := proxyFunc(realm)
+	if err != nil {
+		return fmt.Errorf("realm %s: %s", realm.Name, err)
+	}
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	return nil
+}
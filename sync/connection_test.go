@@ -0,0 +1,243 @@
+package sync
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/**
+ * testPKI is a CA with a server certificate for 127.0.0.1 and a client certificate, all written to a temporary
+ *         directory as PEM files
+ */
+type testPKI struct {
+	dir    string
+	pool   *x509.CertPool
+	server tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "keycloak-sync-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	pki := &testPKI{dir: dir, pool: x509.NewCertPool()}
+	pki.pool.AddCert(ca)
+	pki.write(t, "ca.pem", "CERTIFICATE", caDER)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage, name string) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		pki.write(t, name+".pem", "CERTIFICATE", der)
+		pki.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+		certificate, err := tls.LoadX509KeyPair(pki.path(name+".pem"), pki.path(name+"-key.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certificate
+	}
+	pki.server = issue(2, x509.ExtKeyUsageServerAuth, "server")
+	issue(3, x509.ExtKeyUsageClientAuth, "client")
+
+	return pki
+}
+
+func (pki *testPKI) path(name string) string {
+	return filepath.Join(pki.dir, name)
+}
+
+func (pki *testPKI) write(t *testing.T, name string, kind string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(pki.path(name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/**
+ * mutualTLSServer starts a server that only accepts clients with a certificate from the test CA
+ */
+func (pki *testPKI) mutualTLSServer(t *testing.T, maxVersion uint16) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+		MaxVersion:   maxVersion,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getWithRealm(realm RealmConfig, url string) error {
+	transport := &http.Transport{}
+	if err := configureTransport(realm, transport); err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+	response, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func TestMutualTLS(t *testing.T) {
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+	server := pki.mutualTLSServer(t, 0)
+
+	realm := RealmConfig{
+		Name:      "sso",
+		SslVerify: true,
+		TLS: TLSConfig{
+			CAFile:     pki.path("ca.pem"),
+			CertFile:   pki.path("client.pem"),
+			KeyFile:    pki.path("client-key.pem"),
+			MinVersion: "1.2",
+		},
+	}
+	a.Nil(getWithRealm(realm, server.URL))
+
+	// the server requires the client certificate
+	withoutCertificate := realm
+	withoutCertificate.TLS.CertFile = ""
+	withoutCertificate.TLS.KeyFile = ""
+	a.Error(getWithRealm(withoutCertificate, server.URL))
+
+	// the server certificate is not trusted without the CA bundle
+	withoutCA := realm
+	withoutCA.TLS.CAFile = ""
+	a.Error(getWithRealm(withoutCA, server.URL))
+
+	// the server does not support the minimum version
+	limited := pki.mutualTLSServer(t, tls.VersionTLS12)
+	a.Nil(getWithRealm(realm, limited.URL))
+	tooNew := realm
+	tooNew.TLS.MinVersion = "1.3"
+	a.Error(getWithRealm(tooNew, limited.URL))
+}
+
+func TestCABundleVerifies(t *testing.T) {
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{pki.server}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	// the CA bundle turns verification on even though ssl-verify is false
+	realm := RealmConfig{Name: "sso", TLS: TLSConfig{CAFile: pki.path("ca.pem")}}
+	a.Nil(getWithRealm(realm, server.URL))
+
+	// so a server certificate from another CA is rejected
+	other := newTestPKI(t)
+	realm.TLS.CAFile = other.path("ca.pem")
+	err := getWithRealm(realm, server.URL)
+	a.Error(err)
+	a.Contains(err.Error(), "certificate")
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	a := assert.New(t)
+
+	pki := newTestPKI(t)
+
+	_, err := tlsClientConfig(RealmConfig{TLS: TLSConfig{CAFile: pki.path("missing.pem")}})
+	a.Error(err)
+	_, err = tlsClientConfig(RealmConfig{TLS: TLSConfig{CAFile: pki.path("client-key.pem")}})
+	a.Error(err)
+	a.Contains(err.Error(), "no certificates found")
+	_, err = tlsClientConfig(RealmConfig{TLS: TLSConfig{CertFile: pki.path("client.pem"), KeyFile: pki.path("server-key.pem")}})
+	a.Error(err)
+	_, err = tlsClientConfig(RealmConfig{TLS: TLSConfig{MinVersion: "1.4"}})
+	a.Error(err)
+
+	// without ssl-verify the server is not verified, the same as before
+	config, err := tlsClientConfig(RealmConfig{})
+	a.Nil(err)
+	a.True(config.InsecureSkipVerify)
+
+	// a session that can't be configured can't be used
+	session := newKeycloakSession(RealmConfig{Name: "sso", Url: "https://localhost", TLS: TLSConfig{CAFile: pki.path("missing.pem")}})
+	defer session.close()
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Error(err)
+	a.Contains(err.Error(), "could not read the CA bundle")
+}
+
+func TestProxy(t *testing.T) {
+	a := assert.New(t)
+
+	proxy, err := proxyFunc(RealmConfig{Proxy: ProxyConfig{
+		Url:     "http://proxy.example.com:3128",
+		NoProxy: []string{".internal", "10.0.0.0/8"},
+	}})
+	a.Nil(err)
+
+	proxied := func(url string) string {
+		request, _ := http.NewRequest(http.MethodGet, url, nil)
+		proxyURL, err := proxy(request)
+		a.Nil(err)
+		if proxyURL == nil {
+			return ""
+		}
+		return proxyURL.String()
+	}
+	a.Equal("http://proxy.example.com:3128", proxied("https://sso.example.com/auth"))
+	a.Equal("http://proxy.example.com:3128", proxied("http://sso.example.com/auth"))
+	a.Equal("", proxied("https://sso.corp.internal/auth"))
+	a.Equal("", proxied("https://10.1.2.3/auth"))
+}
@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userapi "github.com/openshift/api/user/v1"
+	"sort"
+)
+
+// annotations that are not part of the content hash. the primary source changes from the realm to "openshift"
+// once the group exists and the sync time changes every time the group is written.
+var unhashedAnnotations = map[string]bool{
+	constants.AnnotationPrimarySource: true,
+	constants.AnnotationSyncedAt:      true,
+	constants.AnnotationContentHash:   true,
+}
+
+/**
+ * hashedContent is the canonical form of a group that is hashed. the users are sorted and the keys of the maps
+ *               are sorted when they are encoded so the same group always has the same hash.
+ */
+type hashedContent struct {
+	Users       []string          `json:"users"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func hashContent(content hashedContent) string {
+	sort.Strings(content.Users)
+	data, err := json.Marshal(content)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * contentHash returns the hash of the users, labels, and annotations that keycloak-sync writes to the group
+ */
+func contentHash(group userapi.Group) string {
+	content := hashedContent{
+		Users:       append([]string{}, group.Users...),
+		Labels:      copyStringMap(group.Labels),
+		Annotations: make(map[string]string),
+	}
+	for key, value := range group.Annotations {
+		if !unhashedAnnotations[key] {
+			content.Annotations[key] = value
+		}
+	}
+	return hashContent(content)
+}
+
+/**
+ * liveContentHash returns the hash of the group as it was read from OpenShift using only the labels and
+ *                 annotations that are in the desired group. other labels and annotations can be added to a group
+ *                 without it being seen as changed.
+ */
+func liveContentHash(live Group, desired userapi.Group) string {
+	content := hashedContent{
+		Users:       append([]string{}, live.LiveUsers...),
+		Labels:      make(map[string]string),
+		Annotations: make(map[string]string),
+	}
+	for key := range desired.Labels {
+		if value, found := live.Labels[key]; found {
+			content.Labels[key] = value
+		}
+	}
+	for key := range desired.Annotations {
+		if value, found := live.Annotations[key]; found && !unhashedAnnotations[key] {
+			content.Annotations[key] = value
+		}
+	}
+	return hashContent(content)
+}
+
+/**
+ * hashChanged uses the content hash recorded on the group in OpenShift to decide if the desired group is a change.
+ *             it is only decided for groups that were read from OpenShift and are still in keycloak, otherwise the
+ *             Changed and Prune flags decide. a group without a recorded hash is changed so that it gets one. when
+ *             the desired group has the recorded hash the group is only changed if it drifted: the group in
+ *             OpenShift no longer matches the hash because it was edited outside of keycloak-sync.
+ */
+func (sg Group) hashChanged(desired userapi.Group) (decided bool, changed bool, drifted bool) {
+	if sg.Source != "openshift" || len(sg.Sources) < 1 {
+		return false, false, false
+	}
+	recorded := sg.Annotations[constants.AnnotationContentHash]
+	if desired.Annotations[constants.AnnotationContentHash] != recorded {
+		return true, true, false
+	}
+	if liveContentHash(sg, desired) != recorded {
+		return true, true, true
+	}
+	return true, false, false
+}
@@ -0,0 +1,110 @@
+package sync
+
+import (
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userapi "github.com/openshift/api/user/v1"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestContentHash(t *testing.T) {
+	a := assert.New(t)
+
+	group := userapi.Group{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "developers",
+			Labels:      map[string]string{"team": "platform"},
+			Annotations: map[string]string{constants.AnnotationRealms: "sso", constants.AnnotationSyncedAt: "2020-01-01T00:00:00Z"},
+		},
+		Users: userapi.OptionalNames{"alice", "bob"},
+	}
+	hash := contentHash(group)
+	a.Len(hash, 64)
+
+	// the order of the users and the sync time do not change the hash
+	group.Users = userapi.OptionalNames{"bob", "alice"}
+	group.Annotations[constants.AnnotationSyncedAt] = "2020-01-02T00:00:00Z"
+	group.Annotations[constants.AnnotationPrimarySource] = "openshift"
+	a.Equal(hash, contentHash(group))
+
+	// the users, labels, and annotations do
+	group.Users = userapi.OptionalNames{"alice"}
+	a.NotEqual(hash, contentHash(group))
+	group.Users = userapi.OptionalNames{"alice", "bob"}
+	group.Labels["team"] = "other"
+	a.NotEqual(hash, contentHash(group))
+	group.Labels["team"] = "platform"
+	group.Annotations[constants.AnnotationRealms] = "sso,other"
+	a.NotEqual(hash, contentHash(group))
+}
+
+func TestContentHashChanges(t *testing.T) {
+	a := assert.New(t)
+
+	keycloakGroup := Group{
+		Name:          "developers",
+		Source:        "realm:sso",
+		Realms:        []string{"sso"},
+		Sources:       []GroupSource{{Realm: "sso", URL: "https://sso.example.com/auth/realms/sso", ID: "id-dev", Path: "/developers"}},
+		SyncedAt:      time.Now(),
+		Users:         map[string]User{"alice": {Name: "alice"}, "bob": {Name: "bob"}},
+		ManagedLabels: map[string]string{"team": "platform"},
+	}
+	written, _ := keycloakGroup.ToOpenShiftGroup(Config{})
+	a.Equal(contentHash(written), written.Annotations[constants.AnnotationContentHash])
+	keycloakGroups := func(group Group) GroupList {
+		group.SyncedAt = group.SyncedAt.Add(time.Hour)
+		return GroupList{"developers": group}
+	}
+	current := func(group userapi.Group) GroupList {
+		return GroupList{"developers": FromOpenShiftGroup(Config{Prune: true}, group)}
+	}
+
+	// the same group read back from openshift with the users in another order is not changed
+	written.Users = userapi.OptionalNames{"bob", "alice"}
+	merged := Merge(current(written), keycloakGroups(keycloakGroup))
+	a.Len(merged.ToOpenShiftGroups(Config{Prune: true}, true).Items, 0)
+	a.Len(Diff(Config{Prune: true}, current(written), merged), 0)
+
+	// even when something else marked it as changed
+	changed := merged["developers"]
+	changed.Changed = true
+	merged["developers"] = changed
+	a.Len(merged.ToOpenShiftGroups(Config{Prune: true}, true).Items, 0)
+
+	// a change to the labels from the realm changes the group
+	relabelled := keycloakGroup.copy()
+	relabelled.ManagedLabels["team"] = "other"
+	merged = Merge(current(written), keycloakGroups(relabelled))
+	a.Len(merged.ToOpenShiftGroups(Config{Prune: true}, true).Items, 1)
+
+	// a user added outside of keycloak-sync is a drift and the group is changed back
+	drifted := written.DeepCopy()
+	drifted.Users = append(drifted.Users, "mallory")
+	merged = Merge(current(*drifted), keycloakGroups(keycloakGroup))
+	output := merged.ToOpenShiftGroups(Config{Prune: true}, true)
+	a.Len(output.Items, 1)
+	a.ElementsMatch([]string{"alice", "bob"}, output.Items[0].Users)
+	a.Equal(written.Annotations[constants.AnnotationContentHash], output.Items[0].Annotations[constants.AnnotationContentHash])
+
+	// a user removed outside of keycloak-sync is added back
+	drifted = written.DeepCopy()
+	drifted.Users = userapi.OptionalNames{"alice"}
+	merged = Merge(current(*drifted), keycloakGroups(keycloakGroup))
+	a.Len(merged.ToOpenShiftGroups(Config{Prune: true}, true).Items, 1)
+
+	// labels and annotations that keycloak-sync does not manage can be added without a change
+	drifted = written.DeepCopy()
+	drifted.Labels["other"] = "value"
+	drifted.Annotations["example.com/other"] = "value"
+	merged = Merge(current(*drifted), keycloakGroups(keycloakGroup))
+	a.Len(merged.ToOpenShiftGroups(Config{Prune: true}, true).Items, 0)
+
+	// a group written before the content hash is changed so that it gets one
+	old := written.DeepCopy()
+	delete(old.Annotations, constants.AnnotationContentHash)
+	merged = Merge(current(*old), keycloakGroups(keycloakGroup))
+	a.Len(merged.ToOpenShiftGroups(Config{Prune: true}, true).Items, 1)
+}
@@ -0,0 +1,290 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
+	userclient "github.com/openshift/client-go/user/clientset/versioned"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// the namespace file that is mounted into pods with a service account
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+/**
+ * ControllerOptions configure how the controller runs
+ */
+type ControllerOptions struct {
+	// time between the end of one reconcile and the start of the next
+	Interval time.Duration
+	// fraction of the interval, up to, that is randomly added to each wait
+	Jitter float64
+	// address for the health and readiness endpoints, they are not served if empty
+	Address string
+
+	// leader election through a Kubernetes Lease
+	LeaderElection bool
+	LeaseName      string
+	LeaseNamespace string
+	Identity       string
+	LeaseDuration  time.Duration
+	RenewDeadline  time.Duration
+	RetryPeriod    time.Duration
+}
+
+/**
+ * Controller reconciles the groups in the cluster with keycloak on an interval. the keycloak sessions are kept
+ *            open between each reconcile.
+ */
+type Controller struct {
+	config     Config
+	options    ControllerOptions
+	userClient userclient.Interface
+	kubeClient kubernetes.Interface
+	sessions   *KeycloakSessions
+
+	mutex       gosync.Mutex
+	leading     bool
+	lastError   error
+	lastSuccess time.Time
+}
+
+/**
+ * NewController creates a controller. the kubernetes client is only needed when leader election is enabled or
+ *               when credentials are read from a Kubernetes Secret.
+ */
+func NewController(config Config, options ControllerOptions, userClient userclient.Interface, kubeClient kubernetes.Interface) (*Controller, error) {
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("the reconcile interval must be greater than zero")
+	}
+	if options.Jitter < 0 {
+		options.Jitter = 0
+	}
+
+	if options.LeaderElection {
+		if kubeClient == nil {
+			return nil, fmt.Errorf("a kubernetes client is required for leader election")
+		}
+		if len(options.LeaseName) < 1 {
+			options.LeaseName = "keycloak-sync"
+		}
+		if len(options.LeaseNamespace) < 1 {
+			namespace, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+			if err != nil {
+				return nil, fmt.Errorf("a lease namespace is required for leader election when not running in a pod")
+			}
+			options.LeaseNamespace = strings.TrimSpace(string(namespace))
+		}
+		if len(options.Identity) < 1 {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("could not determine identity for leader election: %s", err)
+			}
+			options.Identity = hostname
+		}
+		if options.LeaseDuration <= 0 {
+			options.LeaseDuration = 15 * time.Second
+		}
+		if options.RenewDeadline <= 0 {
+			options.RenewDeadline = 10 * time.Second
+		}
+		if options.RetryPeriod <= 0 {
+			options.RetryPeriod = 2 * time.Second
+		}
+	}
+
+	sessions := NewKeycloakSessions()
+	if kubeClient != nil {
+		sessions.SetSecretReader(NewSecretReader(kubeClient))
+	} else if config.UsesSecretRefs() {
+		return nil, fmt.Errorf("a kubernetes client is required to read credentials from a secret")
+	}
+
+	return &Controller{
+		config:     config,
+		options:    options,
+		userClient: userClient,
+		kubeClient: kubeClient,
+		sessions:   sessions,
+	}, nil
+}
+
+/**
+ * Run serves the health endpoints and reconciles until the context is done. with leader election only the
+ *     leader reconciles and the other replicas wait to take over.
+ */
+func (controller *Controller) Run(ctx context.Context) error {
+	defer controller.sessions.Close()
+
+	if len(controller.options.Address) > 0 {
+		server := &http.Server{
+			Addr:    controller.options.Address,
+			Handler: controller.Handler(),
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Errorf("Health endpoint stopped: %s", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = server.Shutdown(shutdownCtx)
+		}()
+	}
+
+	if !controller.options.LeaderElection {
+		controller.setLeading(true)
+		controller.reconcileLoop(ctx)
+		return nil
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: v1.ObjectMeta{
+			Name:      controller.options.LeaseName,
+			Namespace: controller.options.LeaseNamespace,
+		},
+		Client: controller.kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: controller.options.Identity,
+		},
+	}
+
+	// stand for election again whenever leadership is lost until the context is done
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   controller.options.LeaseDuration,
+			RenewDeadline:   controller.options.RenewDeadline,
+			RetryPeriod:     controller.options.RetryPeriod,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					logrus.Infof("%s is now the leader", controller.options.Identity)
+					controller.setLeading(true)
+					controller.reconcileLoop(leaderCtx)
+				},
+				OnStoppedLeading: func() {
+					logrus.Infof("%s is no longer the leader", controller.options.Identity)
+					controller.setLeading(false)
+				},
+				OnNewLeader: func(identity string) {
+					if identity != controller.options.Identity {
+						logrus.Infof("%s is the leader", identity)
+					}
+				},
+			},
+		})
+	}
+
+	return nil
+}
+
+func (controller *Controller) reconcileLoop(ctx context.Context) {
+	for {
+		controller.reconcile(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(controller.nextWait()):
+		}
+	}
+}
+
+func (controller *Controller) reconcile(ctx context.Context) {
+	start := time.Now()
+	result, err := Reconcile(ctx, controller.config, controller.sessions, controller.userClient)
+	// a reconcile that was stopped because the controller is stopping or lost the lease is not a failure
+	if ctx.Err() != nil {
+		logrus.Infof("Reconcile stopped after %s, groups created: %d, updated: %d, deleted: %d", time.Since(start), len(result.Created), len(result.Updated), len(result.Deleted))
+		return
+	}
+	metrics.ObserveSync(err)
+
+	// a sync without an optional realm is still ready, the realm that failed shows in the realm sync metrics
+	_, partial := AsPartialSync(err)
+	controller.mutex.Lock()
+	if err == nil || partial {
+		controller.lastError = nil
+		controller.lastSuccess = time.Now()
+	} else {
+		controller.lastError = err
+	}
+	controller.mutex.Unlock()
+
+	if partial {
+		logrus.Warnf("Reconcile finished in %s without some realms, groups created: %d, updated: %d, deleted: %d: %s", time.Since(start), len(result.Created), len(result.Updated), len(result.Deleted), err)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Reconcile failed after %s: %s", time.Since(start), err)
+		return
+	}
+	logrus.Infof("Reconcile finished in %s, groups created: %d, updated: %d, deleted: %d", time.Since(start), len(result.Created), len(result.Updated), len(result.Deleted))
+}
+
+/**
+ * nextWait returns the interval with a random amount of jitter added so that replicas and restarts spread out
+ */
+func (controller *Controller) nextWait() time.Duration {
+	wait := controller.options.Interval
+	if controller.options.Jitter > 0 {
+		wait += time.Duration(rand.Float64() * controller.options.Jitter * float64(controller.options.Interval))
+	}
+	return wait
+}
+
+func (controller *Controller) setLeading(leading bool) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.leading = leading
+}
+
+/**
+ * Ready is true when the last reconcile succeeded, even if an optional realm could not be read, or when the
+ *       controller is waiting to become the leader
+ */
+func (controller *Controller) Ready() bool {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	if controller.options.LeaderElection && !controller.leading {
+		return true
+	}
+	return controller.lastError == nil && !controller.lastSuccess.IsZero()
+}
+
+/**
+ * Handler serves /healthz, which is always ok while the process is running, /readyz, which reports Ready, and
+ *         /metrics with the Prometheus metrics
+ */
+func (controller *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !controller.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
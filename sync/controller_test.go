@@ -0,0 +1,149 @@
+package sync
+
+import (
+	"context"
+	userfake "github.com/openshift/client-go/user/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func controllerTestConfig(t *testing.T) (*fakeKeycloak, Config) {
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	fake.members[*group.ID] = fakeUsers("dev", 3)
+	return fake, Config{Realms: []RealmConfig{fake.realmConfig()}}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func runController(t *testing.T, controller *Controller) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- controller.Run(ctx)
+	}()
+	return cancel, done
+}
+
+func TestControllerReconciles(t *testing.T) {
+	a := assert.New(t)
+
+	fake, config := controllerTestConfig(t)
+	userClient := userfake.NewSimpleClientset()
+
+	controller, err := NewController(config, ControllerOptions{Interval: 20 * time.Millisecond, Jitter: 0.5}, userClient, nil)
+	a.Nil(err)
+
+	// not ready before the first reconcile
+	recorder := httptest.NewRecorder()
+	controller.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	a.Equal(http.StatusServiceUnavailable, recorder.Code)
+
+	cancel, done := runController(t, controller)
+	waitFor(t, controller.Ready)
+	waitFor(t, func() bool { return fake.count("groups") >= 3 })
+	cancel()
+	a.Nil(<-done)
+
+	// the group was created in the cluster
+	group, err := userClient.UserV1().Groups().Get(context.Background(), "developers", v1.GetOptions{})
+	a.Nil(err)
+	a.Equal(3, len(group.Users))
+
+	// the same login was used for every reconcile and logged out at the end
+	a.Equal(1, fake.count("token"))
+	a.Equal(1, fake.count("logout"))
+
+	recorder = httptest.NewRecorder()
+	controller.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	a.Equal(http.StatusOK, recorder.Code)
+	recorder = httptest.NewRecorder()
+	controller.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	a.Equal(http.StatusOK, recorder.Code)
+
+	// the metrics include the syncs and the requests made to keycloak
+	recorder = httptest.NewRecorder()
+	controller.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	a.Equal(http.StatusOK, recorder.Code)
+	a.Contains(recorder.Body.String(), `keycloak_sync_syncs_total{outcome="success"}`)
+	a.Contains(recorder.Body.String(), `keycloak_sync_groups_changed_total{action="created"}`)
+	a.Contains(recorder.Body.String(), `endpoint="admin/realms/{}/groups/{}/members"`)
+}
+
+func TestControllerReadyWithoutOptionalRealm(t *testing.T) {
+	a := assert.New(t)
+
+	// the second realm is optional and its server is not running
+	_, config := controllerTestConfig(t)
+	down := newFakeKeycloak(t)
+	optional := down.realmConfig()
+	optional.Name = "down"
+	optional.Optional = true
+	down.server.Close()
+	config.Realms = append(config.Realms, optional)
+
+	controller, err := NewController(config, ControllerOptions{Interval: 20 * time.Millisecond}, userfake.NewSimpleClientset(), nil)
+	a.Nil(err)
+	cancel, done := runController(t, controller)
+	waitFor(t, controller.Ready)
+	cancel()
+	a.Nil(<-done)
+
+	recorder := httptest.NewRecorder()
+	controller.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	a.Equal(http.StatusOK, recorder.Code)
+
+	// the realm that could not be read is in the metrics instead
+	recorder = httptest.NewRecorder()
+	controller.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	a.Contains(recorder.Body.String(), `keycloak_sync_realm_syncs_total{outcome="failure",realm="down"}`)
+}
+
+func TestControllerLeaderElection(t *testing.T) {
+	a := assert.New(t)
+
+	_, config := controllerTestConfig(t)
+	userClient := userfake.NewSimpleClientset()
+	kubeClient := kubefake.NewSimpleClientset()
+
+	controller, err := NewController(config, ControllerOptions{
+		Interval:       20 * time.Millisecond,
+		LeaderElection: true,
+		LeaseNamespace: "keycloak-sync",
+		Identity:       "replica-a",
+	}, userClient, kubeClient)
+	a.Nil(err)
+
+	cancel, done := runController(t, controller)
+	waitFor(t, func() bool {
+		_, err := userClient.UserV1().Groups().Get(context.Background(), "developers", v1.GetOptions{})
+		return err == nil
+	})
+
+	lease, err := kubeClient.CoordinationV1().Leases("keycloak-sync").Get(context.Background(), "keycloak-sync", v1.GetOptions{})
+	a.Nil(err)
+	a.Equal("replica-a", *lease.Spec.HolderIdentity)
+	a.True(controller.Ready())
+
+	cancel()
+	a.Nil(<-done)
+}
+
+func TestControllerRequiresInterval(t *testing.T) {
+	_, err := NewController(Config{}, ControllerOptions{}, userfake.NewSimpleClientset(), nil)
+	assert.Error(t, err)
+}
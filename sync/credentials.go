@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// a ${NAME} reference to an environment variable
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+/**
+ * SecretReader reads the value of a key in a Kubernetes Secret
+ */
+type SecretReader interface {
+	ReadSecret(ctx context.Context, ref SecretKeyRef) (string, error)
+}
+
+type kubernetesSecretReader struct {
+	client kubernetes.Interface
+}
+
+/**
+ * NewSecretReader returns a SecretReader that gets secrets from the cluster with the given client
+ */
+func NewSecretReader(client kubernetes.Interface) SecretReader {
+	return &kubernetesSecretReader{client: client}
+}
+
+func (reader *kubernetesSecretReader) ReadSecret(ctx context.Context, ref SecretKeyRef) (string, error) {
+	namespace := ref.Namespace
+	if len(namespace) < 1 {
+		podNamespace, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return "", fmt.Errorf("a namespace is required for the secret %s when not running in a pod", ref.Name)
+		}
+		namespace = strings.TrimSpace(string(podNamespace))
+	}
+	secret, err := reader.client.CoreV1().Secrets(namespace).Get(ctx, ref.Name, v1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not read the secret %s/%s: %s", namespace, ref.Name, err)
+	}
+	value, found := secret.Data[ref.Key]
+	if !found {
+		return "", fmt.Errorf("the secret %s/%s does not have the key %s", namespace, ref.Name, ref.Key)
+	}
+	return string(value), nil
+}
+
+/**
+ * interpolateEnv replaces each ${NAME} in the value with the environment variable of that name. a variable that
+ *                is not set is an error so that an empty credential is not sent by mistake.
+ */
+func interpolateEnv(value string) (string, error) {
+	var missing []string
+	result := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		variable, found := os.LookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return variable
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("the environment variable(s) %s are not set", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+/**
+ * resolveCredential returns the credential from the first source that is set: the value itself, the file, or the
+ *                   Kubernetes Secret. files are read each time so that a mounted Secret that is updated is used
+ *                   for the next login.
+ */
+func resolveCredential(ctx context.Context, secrets SecretReader, value string, file string, ref *SecretKeyRef) (string, error) {
+	switch {
+	case len(file) > 0:
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read the credential file: %s", err)
+		}
+		// files written by editors and "echo" end with a newline that is not part of the credential
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case ref != nil:
+		if secrets == nil {
+			return "", errors.New("credentials in a Kubernetes Secret can only be read when applying to the cluster")
+		}
+		return secrets.ReadSecret(ctx, *ref)
+	default:
+		return interpolateEnv(value)
+	}
+}
+
+/**
+ * withCredentials returns a copy of the realm with the client secret or user password read from its source
+ */
+func withCredentials(ctx context.Context, secrets SecretReader, realm RealmConfig) (RealmConfig, error) {
+	if realm.ClientConfig != nil && realm.ClientConfig.AuthMethod() == ClientAuthSecret {
+		client := *realm.ClientConfig
+		secret, err := resolveCredential(ctx, secrets, client.ClientSecret, client.SecretFile, client.SecretRef)
+		if err != nil {
+			return realm, fmt.Errorf("realm %s: client secret: %s", realm.Name, err)
+		}
+		client.ClientSecret, client.SecretFile, client.SecretRef = secret, "", nil
+		realm.ClientConfig = &client
+	}
+	if realm.UserConfig != nil {
+		user := *realm.UserConfig
+		password, err := resolveCredential(ctx, secrets, user.Password, user.PasswordFile, user.PasswordRef)
+		if err != nil {
+			return realm, fmt.Errorf("realm %s: user password: %s", realm.Name, err)
+		}
+		user.Password, user.PasswordFile, user.PasswordRef = password, "", nil
+		realm.UserConfig = &user
+	}
+	return realm, nil
+}
@@ -0,0 +1,179 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * checkClientSecret only gives a token to the client when it sends the expected secret
+ */
+func checkClientSecret(expected string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		_, secret, _ := r.BasicAuth()
+		if secret != expected {
+			return errors.New("wrong client secret")
+		}
+		return nil
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	a := assert.New(t)
+
+	_ = os.Setenv("KEYCLOAK_SYNC_TEST_SECRET", "from-env")
+	defer func() { _ = os.Unsetenv("KEYCLOAK_SYNC_TEST_SECRET") }()
+
+	value, err := interpolateEnv("${KEYCLOAK_SYNC_TEST_SECRET}")
+	a.Nil(err)
+	a.Equal("from-env", value)
+	value, err = interpolateEnv("prefix-${KEYCLOAK_SYNC_TEST_SECRET}-$NOT_A_REFERENCE")
+	a.Nil(err)
+	a.Equal("prefix-from-env-$NOT_A_REFERENCE", value)
+
+	_, err = interpolateEnv("${KEYCLOAK_SYNC_TEST_MISSING}")
+	a.Error(err)
+	a.Contains(err.Error(), "KEYCLOAK_SYNC_TEST_MISSING")
+}
+
+func TestSecretFile(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "keycloak-sync-secret")
+	a.Nil(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	secretFile := filepath.Join(dir, "secret")
+	a.Nil(ioutil.WriteFile(secretFile, []byte("from-file\n"), 0600))
+
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	fake.tokenCheck = checkClientSecret("from-file")
+
+	realm := fake.realmConfig()
+	realm.ClientConfig = &ClientConfig{ClientId: "client", SecretFile: secretFile}
+	session := newKeycloakSession(realm)
+	defer session.close()
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+
+	// the file is read again when the session logs in again so a rotated secret is used
+	a.Nil(ioutil.WriteFile(secretFile, []byte("rotated"), 0600))
+	fake.tokenCheck = checkClientSecret("rotated")
+	session.mutex.Lock()
+	session.logout()
+	session.mutex.Unlock()
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+
+	// the configuration in the session still points to the file
+	a.Equal("", session.realm.ClientConfig.ClientSecret)
+}
+
+func TestSecretRef(t *testing.T) {
+	a := assert.New(t)
+
+	kubeClient := kubefake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "keycloak", Namespace: "sso"},
+		Data:       map[string][]byte{"client-secret": []byte("from-secret")},
+	})
+	secrets := NewSecretReader(kubeClient)
+
+	value, err := secrets.ReadSecret(context.Background(), SecretKeyRef{Namespace: "sso", Name: "keycloak", Key: "client-secret"})
+	a.Nil(err)
+	a.Equal("from-secret", value)
+	_, err = secrets.ReadSecret(context.Background(), SecretKeyRef{Namespace: "sso", Name: "keycloak", Key: "password"})
+	a.Error(err)
+	a.Contains(err.Error(), "does not have the key password")
+	_, err = secrets.ReadSecret(context.Background(), SecretKeyRef{Namespace: "sso", Name: "missing", Key: "password"})
+	a.Error(err)
+
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	fake.tokenCheck = checkClientSecret("from-secret")
+
+	realm := fake.realmConfig()
+	realm.ClientConfig = &ClientConfig{ClientId: "client", SecretRef: &SecretKeyRef{Namespace: "sso", Name: "keycloak", Key: "client-secret"}}
+	sessions := NewKeycloakSessions()
+	sessions.SetSecretReader(secrets)
+	defer sessions.Close()
+	_, err = sessions.GetKeycloakGroupsFromRealm(context.Background(), realm)
+	a.Nil(err)
+
+	// without a connection to the cluster the secret can't be read
+	session := newKeycloakSession(realm)
+	defer session.close()
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Error(err)
+	a.Contains(err.Error(), "can only be read when applying to the cluster")
+}
+
+func TestSessionsForEachRealmEntry(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	fake.tokenCheck = checkClientSecret("second")
+
+	// two entries for the same realm with different credentials
+	first := fake.realmConfig()
+	first.ClientConfig = &ClientConfig{ClientId: "client", ClientSecret: "first"}
+	second := fake.realmConfig()
+	second.ClientConfig = &ClientConfig{ClientId: "client", ClientSecret: "second"}
+
+	sessions := NewKeycloakSessions()
+	defer sessions.Close()
+	a.True(sessions.get(first) != sessions.get(second))
+	a.True(sessions.get(second) == sessions.get(second))
+
+	// the second entry logs in with its own credentials
+	_, err := sessions.GetKeycloakGroupsFromRealm(context.Background(), first)
+	a.Error(err)
+	_, err = sessions.GetKeycloakGroupsFromRealm(context.Background(), second)
+	a.Nil(err)
+
+	// the tls settings are part of the session too
+	verified := second
+	verified.SslVerify = false
+	a.True(sessions.get(verified) != sessions.get(second))
+}
+
+func TestCredentialConfig(t *testing.T) {
+	a := assert.New(t)
+
+	_ = os.Setenv("KEYCLOAK_SYNC_TEST_PASSWORD", "admin")
+	defer func() { _ = os.Unsetenv("KEYCLOAK_SYNC_TEST_PASSWORD") }()
+
+	config := loadTestConfig("credentials.yml", t)
+	a.True(config.UsesSecretRefs())
+	a.Equal("/var/run/secrets/keycloak/client-secret", config.Realms[0].ClientConfig.SecretFile)
+	a.Equal("keycloak", config.Realms[1].ClientConfig.SecretRef.Name)
+	a.Equal("client-secret", config.Realms[1].ClientConfig.SecretRef.Key)
+	a.Equal("${KEYCLOAK_SYNC_TEST_PASSWORD}", config.Realms[2].UserConfig.Password)
+
+	realm, err := withCredentials(context.Background(), nil, config.Realms[2])
+	a.Nil(err)
+	a.Equal("admin", realm.UserConfig.Password)
+	// the configuration is not changed
+	a.Equal("${KEYCLOAK_SYNC_TEST_PASSWORD}", config.Realms[2].UserConfig.Password)
+
+	_, err = loadTestConfigWithError("credentials_two_sources.yml", t)
+	a.Error(err)
+	a.Contains(err.Error(), "one_auth_method")
+	a.Contains(err.Error(), "one_password_source")
+
+	_, err = loadTestConfigWithError("credentials_no_source.yml", t)
+	a.Error(err)
+	a.Contains(err.Error(), "Password")
+}
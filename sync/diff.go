@@ -0,0 +1,246 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	DiffCreated = "created"
+	DiffUpdated = "updated"
+	DiffDeleted = "deleted"
+)
+
+/**
+ * GroupDiff describes the change in membership that a sync makes to a single OpenShift group
+ */
+type GroupDiff struct {
+	Name    string   `json:"name"`
+	Action  string   `json:"action"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// users in the group before the change, used to give context in unified output
+	Before []string `json:"-"`
+	// users in the group after the change, used to give context in unified output
+	After []string `json:"-"`
+}
+
+/**
+ * GroupDiffList is a list of group changes sorted by group name
+ */
+type GroupDiffList []GroupDiff
+
+/**
+ * Diff compares the groups currently in OpenShift with the result of merging the keycloak groups on to them and
+ *      returns the change to each group that would be made. groups that are not changed (according to the same
+ *      content hash or Changed and Prune flags that ToOpenShiftGroups uses) are not in the list.
+ */
+func Diff(config Config, current GroupList, final GroupList) GroupDiffList {
+	diffs := make(GroupDiffList, 0)
+
+	for _, group := range final {
+		if group.Skipped {
+			continue
+		}
+
+		name := group.FinalName()
+		before := make([]string, 0)
+		currentGroup, exists := current[name]
+		if exists {
+			for userName := range currentGroup.Users {
+				before = append(before, userName)
+			}
+		}
+		sort.Strings(before)
+
+		if group.shouldDelete(config) {
+			diffs = append(diffs, GroupDiff{
+				Name:    name,
+				Action:  DiffDeleted,
+				Removed: before,
+				Before:  before,
+				After:   []string{},
+			})
+			continue
+		}
+
+		openshiftGroup, changed := group.ToOpenShiftGroup(config)
+		if decided, hashChanged, _ := group.hashChanged(openshiftGroup); decided {
+			changed = hashChanged
+		}
+		if exists && !changed {
+			continue
+		}
+		after := make([]string, 0, len(openshiftGroup.Users))
+		after = append(after, openshiftGroup.Users...)
+		sort.Strings(after)
+
+		added, removed := compareUsers(before, after)
+		diff := GroupDiff{
+			Name:    name,
+			Action:  DiffUpdated,
+			Added:   added,
+			Removed: removed,
+			Before:  before,
+			After:   after,
+		}
+		if !exists {
+			diff.Action = DiffCreated
+		} else if len(added) < 1 && len(removed) < 1 {
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Name < diffs[j].Name
+	})
+
+	return diffs
+}
+
+/**
+ * compareUsers takes two sorted lists of users and returns the users that were added and removed
+ */
+func compareUsers(before []string, after []string) ([]string, []string) {
+	added := make([]string, 0)
+	removed := make([]string, 0)
+
+	beforeIdx, afterIdx := 0, 0
+	for beforeIdx < len(before) || afterIdx < len(after) {
+		switch {
+		case afterIdx >= len(after) || (beforeIdx < len(before) && before[beforeIdx] < after[afterIdx]):
+			removed = append(removed, before[beforeIdx])
+			beforeIdx++
+		case beforeIdx >= len(before) || after[afterIdx] < before[beforeIdx]:
+			added = append(added, after[afterIdx])
+			afterIdx++
+		default:
+			beforeIdx++
+			afterIdx++
+		}
+	}
+
+	return added, removed
+}
+
+/**
+ * Observe records each change in the metrics, used when the changes are written out instead of applied
+ */
+func (diffs GroupDiffList) Observe() {
+	for _, diff := range diffs {
+		metrics.ObserveGroupChange(diff.Action, len(diff.Added), len(diff.Removed))
+	}
+}
+
+/**
+ * HasChanges returns true if any group is changed
+ */
+func (diffs GroupDiffList) HasChanges() bool {
+	return len(diffs) > 0
+}
+
+/**
+ * Write writes the list of changes in the given format, either "text", "json", or "unified"
+ */
+func (diffs GroupDiffList) Write(format string, writer io.Writer) error {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "json":
+		return diffs.WriteJSON(writer)
+	case "unified", "diff":
+		return diffs.WriteUnified(writer)
+	case "text", "":
+		return diffs.WriteText(writer)
+	default:
+		return fmt.Errorf("unknown diff format %s", format)
+	}
+}
+
+/**
+ * WriteText writes one human readable line for each group like "group sso-dev: +alice, -bob"
+ */
+func (diffs GroupDiffList) WriteText(writer io.Writer) error {
+	for _, diff := range diffs {
+		changes := make([]string, 0, len(diff.Added)+len(diff.Removed))
+		for _, user := range diff.Added {
+			changes = append(changes, "+"+user)
+		}
+		for _, user := range diff.Removed {
+			changes = append(changes, "-"+user)
+		}
+
+		var line string
+		switch diff.Action {
+		case DiffDeleted:
+			line = fmt.Sprintf("group %s: deleted", diff.Name)
+		case DiffCreated:
+			line = fmt.Sprintf("group %s: created", diff.Name)
+			if len(changes) > 0 {
+				line = line + " " + strings.Join(changes, ", ")
+			}
+		default:
+			line = fmt.Sprintf("group %s: %s", diff.Name, strings.Join(changes, ", "))
+		}
+
+		if _, err := fmt.Fprintln(writer, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * WriteJSON writes the list of changes as a json array
+ */
+func (diffs GroupDiffList) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(diffs)
+}
+
+/**
+ * WriteUnified writes the changes as a unified diff where each group is a file with one user on each line
+ */
+func (diffs GroupDiffList) WriteUnified(writer io.Writer) error {
+	var builder strings.Builder
+	for _, diff := range diffs {
+		fromFile := "a/groups/" + diff.Name
+		toFile := "b/groups/" + diff.Name
+		if diff.Action == DiffCreated {
+			fromFile = "/dev/null"
+		} else if diff.Action == DiffDeleted {
+			toFile = "/dev/null"
+		}
+		builder.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", fromFile, toFile))
+		builder.WriteString(fmt.Sprintf("@@ -%s +%s @@\n", unifiedRange(len(diff.Before)), unifiedRange(len(diff.After))))
+
+		beforeIdx, afterIdx := 0, 0
+		for beforeIdx < len(diff.Before) || afterIdx < len(diff.After) {
+			switch {
+			case afterIdx >= len(diff.After) || (beforeIdx < len(diff.Before) && diff.Before[beforeIdx] < diff.After[afterIdx]):
+				builder.WriteString("-" + diff.Before[beforeIdx] + "\n")
+				beforeIdx++
+			case beforeIdx >= len(diff.Before) || diff.After[afterIdx] < diff.Before[beforeIdx]:
+				builder.WriteString("+" + diff.After[afterIdx] + "\n")
+				afterIdx++
+			default:
+				builder.WriteString(" " + diff.Before[beforeIdx] + "\n")
+				beforeIdx++
+				afterIdx++
+			}
+		}
+	}
+	_, err := io.WriteString(writer, builder.String())
+	return err
+}
+
+func unifiedRange(lines int) string {
+	if lines < 1 {
+		return "0,0"
+	}
+	return fmt.Sprintf("1,%d", lines)
+}
@@ -0,0 +1,95 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func diffTestGroups(t *testing.T) (Config, GroupDiffList) {
+	config := Config{
+		Prune:       true,
+		PruneGroups: true,
+		Realms:      []RealmConfig{{Name: "sso"}, {Name: "partner"}},
+	}
+	openshiftGroups, err := GetOpenShiftGroupsFromReader(config, loadTestGroupFile("input-group-owned.yml", t))
+	if err != nil {
+		t.Fatalf("could not read owned groups: %s", err)
+	}
+	keycloakGroups := GroupList{
+		"sso-current": Group{Name: "sso-current", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test1": {Name: "test1"},
+			"alice": {Name: "alice"},
+		}},
+		"no-realms": Group{Name: "no-realms", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test3": {Name: "test3"},
+		}},
+		"sso-new": Group{Name: "sso-new", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"bob": {Name: "bob"},
+		}},
+	}
+	return config, Diff(config, openshiftGroups, Merge(openshiftGroups, keycloakGroups))
+}
+
+func TestDiffText(t *testing.T) {
+	a := assert.New(t)
+
+	_, diffs := diffTestGroups(t)
+	a.True(diffs.HasChanges())
+
+	var buffer bytes.Buffer
+	a.Nil(diffs.Write("text", &buffer))
+	a.Equal("group partner-removed: deleted\n"+
+		"group sso-current: +alice\n"+
+		"group sso-new: created +bob\n"+
+		"group sso-removed: deleted\n", buffer.String())
+}
+
+func TestDiffJSON(t *testing.T) {
+	a := assert.New(t)
+
+	_, diffs := diffTestGroups(t)
+
+	var buffer bytes.Buffer
+	a.Nil(diffs.Write("json", &buffer))
+	decoded := make([]GroupDiff, 0)
+	a.Nil(json.Unmarshal(buffer.Bytes(), &decoded))
+	a.Equal(4, len(decoded))
+	a.Equal("sso-removed", decoded[3].Name)
+	a.Equal(DiffDeleted, decoded[3].Action)
+	a.Equal([]string{"test1", "test2"}, decoded[3].Removed)
+}
+
+func TestDiffUnified(t *testing.T) {
+	a := assert.New(t)
+
+	_, diffs := diffTestGroups(t)
+
+	var buffer bytes.Buffer
+	a.Nil(diffs.Write("unified", &buffer))
+	a.Equal("--- a/groups/partner-removed\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-test3\n"+
+		"--- a/groups/sso-current\n+++ b/groups/sso-current\n@@ -1,1 +1,2 @@\n+alice\n test1\n"+
+		"--- /dev/null\n+++ b/groups/sso-new\n@@ -0,0 +1,1 @@\n+bob\n"+
+		"--- a/groups/sso-removed\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-test1\n-test2\n", buffer.String())
+}
+
+func TestDiffNoChanges(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{Prune: true}
+	openshiftGroups, err := GetOpenShiftGroupsFromReader(config, loadTestGroupFile("input-group-single.yml", t))
+	a.Nil(err)
+	keycloakGroups := GroupList{
+		"developers": Group{Name: "developers", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test1": {Name: "test1"},
+			"test2": {Name: "test2"},
+		}},
+	}
+
+	diffs := Diff(config, openshiftGroups, Merge(openshiftGroups, keycloakGroups))
+	a.False(diffs.HasChanges())
+
+	var buffer bytes.Buffer
+	a.Error(diffs.Write("xml", &buffer))
+}
@@ -2,12 +2,17 @@ package sync
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/Nerzal/gocloak/v7"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
@@ -21,16 +26,16 @@ type keycloakEnhancedGroup struct {
 	parent *Group
 }
 
-func loginKeyCloak(client gocloak.GoCloak, realm RealmConfig) (*gocloak.JWT, error) {
-	ctx := context.Background()
-
+func loginKeyCloak(ctx context.Context, client gocloak.GoCloak, realm RealmConfig) (*gocloak.JWT, error) {
 	clientConfig := realm.ClientConfig
 	userConfig := realm.UserConfig
 
 	var token *gocloak.JWT
 	var err error
 
-	if clientConfig != nil {
+	if clientConfig != nil && clientConfig.AuthMethod() != ClientAuthSecret {
+		token, err = loginClientWithoutSecret(ctx, client, realm)
+	} else if clientConfig != nil {
 		token, err = client.LoginClient(ctx, clientConfig.ClientId, clientConfig.ClientSecret, realm.Name)
 		if err != nil {
 			return token, err
@@ -65,7 +70,12 @@ func logoutKeyCloak(client gocloak.GoCloak, realm RealmConfig, token *gocloak.JW
 	clientConfig := realm.ClientConfig
 	userConfig := realm.UserConfig
 
-	if clientConfig != nil {
+	if clientConfig != nil && clientConfig.AuthMethod() != ClientAuthSecret {
+		// tokens from the client credentials grant usually don't have a refresh token and so there is no session
+		if len(token.RefreshToken) > 0 {
+			err = logoutClientWithoutSecret(context.Background(), client, realm, token.RefreshToken)
+		}
+	} else if clientConfig != nil {
 		err = client.Logout(context.Background(), clientConfig.ClientId, clientConfig.ClientSecret, realm.Name, token.RefreshToken)
 	} else if userConfig != nil {
 		// determine where to logout
@@ -84,20 +94,32 @@ func logoutKeyCloak(client gocloak.GoCloak, realm RealmConfig, token *gocloak.JW
 /**
  * getGroupsByName returns a list of all the groups (and their subgroups) that match the given "groupName" value. Because
  *                 the keycloak api returns the _root_ group given for a subgroup name this needs to walk up the tree and
- *                 then collect and return relevant subgroups or the "by name" will only work for groups at the root level
+ *                 then collect and return relevant subgroups or the "by name" will only work for groups at the root level.
+ *                 newer versions of keycloak do not return the subgroups inline so they are requested page by page
+ *                 in the same way as when all groups are collected.
  */
-func getGroupsByName(client gocloak.GoCloak, realm RealmConfig, accessToken string, groupName string) (*[]*gocloak.Group, error) {
-	// get all groups and users for each group
-	groups, err := client.GetGroups(context.Background(), accessToken, realm.Name, gocloak.GetGroupsParams{
-		Search: &groupName,
+func getGroupsByName(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, accessToken string, groupName string) (*[]*gocloak.Group, error) {
+	// get all groups that match the search, one page at a time
+	groups := make([]*gocloak.Group, 0)
+	err := paginate(realm.GetPageSize(), func(first int, max int) (int, error) {
+		page, err := client.GetGroups(ctx, accessToken, realm.Name, gocloak.GetGroupsParams{
+			Search:              &groupName,
+			First:               &first,
+			Max:                 &max,
+			BriefRepresentation: briefRepresentation(realm),
+		})
+		if err != nil {
+			return 0, err
+		}
+		if page == nil {
+			return 0, fmt.Errorf("a nil response not expected for groups from realm %s", realm.Name)
+		}
+		groups = append(groups, page...)
+		return len(page), nil
 	})
-
 	if err != nil {
 		return nil, err
 	}
-	if groups == nil {
-		return nil, fmt.Errorf("a nil response not expected for groups from realm %s", realm.Name)
-	}
 
 	// output groups collects output structure
 	var outputGroups []*gocloak.Group
@@ -107,7 +129,9 @@ func getGroupsByName(client gocloak.GoCloak, realm RealmConfig, accessToken stri
 		return &groups, nil
 	}
 
-	// go through groups and collect up subgroups as well
+	// go through groups and collect up subgroups as well, the first request for subgroups decides if the server
+	// can list them
+	subGroupsChecked, subGroupsSupported := false, true
 	idx := 0
 	for {
 		if idx >= len(groups) {
@@ -130,8 +154,21 @@ func getGroupsByName(client gocloak.GoCloak, realm RealmConfig, accessToken stri
 		// to find groups at the subgroup level _by name_, having realm.Subgroups as false will be used
 		// in the main reconcile loop to prevent having to walk through the groups and fill them all out
 		if group.SubGroups != nil && len(*group.SubGroups) > 0 {
-			for _, subGroup := range *group.SubGroups {
-				groups = append(groups, &subGroup)
+			// older versions of keycloak return the subgroups with the group
+			for subIdx := range *group.SubGroups {
+				groups = append(groups, &(*group.SubGroups)[subIdx])
+			}
+		} else if subGroupsSupported && group.ID != nil {
+			// newer versions need them to be requested page by page
+			subGroups, err := getSubGroups(ctx, client, realm, accessToken, *group.ID)
+			if err == errSubGroupsUnsupported && !subGroupsChecked {
+				subGroupsSupported = false
+			} else if err != nil {
+				return nil, fmt.Errorf("could not get subgroups of group %s: %s", *group.ID, err)
+			}
+			subGroupsChecked = true
+			for subIdx := range subGroups {
+				groups = append(groups, &subGroups[subIdx])
 			}
 		}
 	}
@@ -139,57 +176,221 @@ func getGroupsByName(client gocloak.GoCloak, realm RealmConfig, accessToken stri
 	return &outputGroups, nil
 }
 
-func getGroupsForRealm(client gocloak.GoCloak, realm RealmConfig, accessToken string) (*[]*gocloak.Group, error) {
-	// get all groups and users for each group
-	groups, err := client.GetGroups(context.Background(), accessToken, realm.Name, gocloak.GetGroupsParams{})
+func getGroupsForRealm(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, accessToken string) (*[]*gocloak.Group, error) {
+	// get all groups, one page at a time
+	groups := make([]*gocloak.Group, 0)
+	err := paginate(realm.GetPageSize(), func(first int, max int) (int, error) {
+		page, err := client.GetGroups(ctx, accessToken, realm.Name, gocloak.GetGroupsParams{
+			First:               &first,
+			Max:                 &max,
+			BriefRepresentation: briefRepresentation(realm),
+		})
+		if err != nil {
+			return 0, err
+		}
+		if page == nil {
+			return 0, fmt.Errorf("a nil response not expected for groups from realm %s", realm.Name)
+		}
+		groups = append(groups, page...)
+		return len(page), nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if groups == nil {
-		return nil, fmt.Errorf("a nil response not expected for groups from realm %s", realm.Name)
-	}
 
 	return &groups, nil
 }
 
-func getUsersForGroup(client gocloak.GoCloak, realm RealmConfig, group Group, accessToken string) ([]*gocloak.User, error) {
+/**
+ * briefRepresentation returns false when the attributes of the groups are needed. keycloak leaves the attributes
+ *                     out of lists of groups unless a full representation is requested.
+ */
+func briefRepresentation(realm RealmConfig) *bool {
+	return gocloak.BoolP(!realm.needsGroupAttributes())
+}
+
+// returned when the keycloak server does not provide the endpoint for listing the children of a group
+var errSubGroupsUnsupported = errors.New("listing subgroups is not supported by the keycloak server")
+
+/**
+ * getSubGroups returns the direct children of the given group. newer versions of keycloak do not return the
+ *              subgroups inline with the group representation and instead provide a paginated endpoint to list
+ *              them. older versions of keycloak return the full tree inline and do not have the endpoint so
+ *              errSubGroupsUnsupported is returned for a 404 or 405 on the first page to allow the caller to stop
+ *              asking. callers only trust that on their first request because a 404 later on is a missing group.
+ */
+func getSubGroups(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, accessToken string, groupID string) ([]gocloak.Group, error) {
+	childrenUrl := adminUrl(realm, "groups", groupID, "children")
+
+	subGroups := make([]gocloak.Group, 0)
+	err := paginate(realm.GetPageSize(), func(first int, max int) (int, error) {
+		var page []gocloak.Group
+		resp, err := client.RestyClient().R().
+			SetContext(ctx).
+			SetAuthToken(accessToken).
+			SetQueryParams(map[string]string{
+				"first":               strconv.Itoa(first),
+				"max":                 strconv.Itoa(max),
+				"briefRepresentation": strconv.FormatBool(*briefRepresentation(realm)),
+			}).
+			SetResult(&page).
+			Get(childrenUrl)
+		if err != nil {
+			return 0, err
+		}
+		if first == 0 && (resp.StatusCode() == http.StatusNotFound || resp.StatusCode() == http.StatusMethodNotAllowed) {
+			return 0, errSubGroupsUnsupported
+		}
+		if resp.IsError() {
+			return 0, fmt.Errorf("could not get subgroups for group %s from realm %s: %s", groupID, realm.Name, resp.Status())
+		}
+		subGroups = append(subGroups, page...)
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return subGroups, nil
+}
+
+/**
+ * adminUrl returns the url for the given path in the admin api of the realm, each part of the path is escaped
+ */
+func adminUrl(realm RealmConfig, parts ...string) string {
+	var builder strings.Builder
+	builder.WriteString(strings.TrimRight(realm.Url, "/"))
+	builder.WriteString("/auth/admin/realms/")
+	builder.WriteString(url.PathEscape(realm.Name))
+	for _, part := range parts {
+		builder.WriteString("/")
+		builder.WriteString(url.PathEscape(part))
+	}
+	return builder.String()
+}
+
+func getUsersForGroup(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, group Group, accessToken string) ([]*gocloak.User, error) {
 	truePtr := true
 	falsePtr := false
-	usersInGroup, err := client.GetGroupMembers(context.Background(), accessToken, realm.Name, group.Id, gocloak.GetGroupsParams{
-		Full:                &truePtr,
-		BriefRepresentation: &falsePtr,
+
+	// get all members of the group, one page at a time
+	usersInGroup := make([]*gocloak.User, 0)
+	err := paginate(realm.GetPageSize(), func(first int, max int) (int, error) {
+		page, err := client.GetGroupMembers(ctx, accessToken, realm.Name, group.Id, gocloak.GetGroupsParams{
+			Full:                &truePtr,
+			BriefRepresentation: &falsePtr,
+			First:               &first,
+			Max:                 &max,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if page == nil {
+			return 0, fmt.Errorf("a nil response not expected for users in group %s from realm %s", group.Name, realm.Name)
+		}
+		usersInGroup = append(usersInGroup, page...)
+		return len(page), nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	if usersInGroup == nil {
-		return nil, fmt.Errorf("a nil response not expected for users in group %s from realm %s", group.Name, realm.Name)
-	}
 	return usersInGroup, nil
 }
 
-func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
-	syncGroups := make(map[string]Group)
+/**
+ * paginate calls the fetch function with the offset and size of each page until the fetch function returns a
+ *          page that is smaller than the page size or an error occurs. the fetch function is responsible for
+ *          collecting the results and returning the number of items in the page it retrieved.
+ */
+func paginate(pageSize int, fetch func(first int, max int) (int, error)) error {
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	first := 0
+	for {
+		count, err := fetch(first, pageSize)
+		if err != nil {
+			return err
+		}
+		if count < pageSize {
+			return nil
+		}
+		first += count
+	}
+}
 
-	// create client for realm
-	client := gocloak.NewClient(realm.Url)
-	restyClient := client.RestyClient()
-	if viper.GetBool("keycloak-debug") {
-		restyClient.SetDebug(true)
+/**
+ * getGroupsAndUsersForRealm reads the groups and their members from the realm. every request for the realm,
+ *                           including logging in, has to finish before the deadline of the realm (if it has one) and
+ *                           is cancelled with the given context.
+ */
+func getGroupsAndUsersForRealm(ctx context.Context, session *keycloakSession) (map[string]Group, error) {
+	if deadline := session.realm.Deadline; deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
 	}
-	if !realm.SslVerify {
-		restyClient.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+
+	groups, err := collectGroupsAndUsers(ctx, session)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return groups, fmt.Errorf("realm %s did not finish within the deadline of %s: %s", session.realm.Name, session.realm.Deadline, err)
 	}
+	return groups, err
+}
+
+func collectGroupsAndUsers(ctx context.Context, session *keycloakSession) (map[string]Group, error) {
+	syncGroups := make(map[string]Group)
 
-	// login with client and get token
-	token, err := loginKeyCloak(client, realm)
+	client := session.client
+	realm := session.realm
+
+	// compile the member filters and group rules before making any requests
+	filter, err := newMemberFilter(realm.MemberFilters)
 	if err != nil {
-		if token != nil && len(token.RefreshToken) > 0 {
-			logoutErr := logoutKeyCloak(client, realm, token)
-			if logoutErr != nil {
-				logrus.Warnf("realm %s | could not log out: %s", realm.Name, err)
-			}
+		return syncGroups, err
+	}
+	rules, err := newGroupRules(realm.GroupRules)
+	if err != nil {
+		return syncGroups, err
+	}
+	nameTemplate, err := newNameTemplate(realm)
+	if err != nil {
+		return syncGroups, err
+	}
+	normalizer, err := newNameNormalizer(realm.NameRules)
+	if err != nil {
+		return syncGroups, err
+	}
+	metadata, err := newGroupMetadata(realm)
+	if err != nil {
+		return syncGroups, err
+	}
+	syncedAt := time.Now()
+
+	// every group name that can't be used in OpenShift is collected so that they can all be reported together
+	nameProblems := make([]string, 0)
+	// final names to the description of the group that has the name and the keycloak group (or role) it is. the
+	// same keycloak group can be found more than once (like by two names in the groups list) without a collision
+	// but two different groups can't have the same name, even when they had the same name before the name rules.
+	claimedBy := make(map[string]string)
+	claimedFrom := make(map[string]string)
+	claimName := func(finalName string, source string, description string) bool {
+		if reasons := validateGroupName(finalName); len(reasons) > 0 {
+			nameProblems = append(nameProblems, fmt.Sprintf("%s has the name %q which %s", description, finalName, strings.Join(reasons, ", ")))
+			return false
 		}
+		if from, found := claimedFrom[finalName]; found && from != source {
+			nameProblems = append(nameProblems, fmt.Sprintf("%s and %s are both named %q", claimedBy[finalName], description, finalName))
+			return false
+		}
+		claimedBy[finalName] = description
+		claimedFrom[finalName] = source
+		return true
+	}
+
+	// login with client and get token (or reuse the token from a previous sync)
+	accessToken, err := session.accessToken(ctx)
+	if err != nil {
 		return syncGroups, err
 	}
 
@@ -203,11 +404,14 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 			if len(groupName) < 1 {
 				continue
 			}
-			// get groups by name from keycloak
-			groups, err := getGroupsByName(client, realm, token.AccessToken, groupName)
+			// get groups by name from keycloak, a group that is not found is left out but any other error fails the
+			// realm so that the groups created for it are not pruned
+			groups, err := getGroupsByName(ctx, client, realm, accessToken, groupName)
 			if err != nil {
-				logrus.Warnf("realm %s | could not get group named %s", realm.Name, groupName)
-				continue
+				return syncGroups, fmt.Errorf("could not get group named %s: %s", groupName, err)
+			}
+			if len(*groups) < 1 {
+				logrus.Warnf("realm %s | no group named %s", realm.Name, groupName)
 			}
 			// for the list of found groups go through them and add them to the list
 			for _, foundGroup := range *groups {
@@ -216,16 +420,12 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 				}
 				gcg = append(gcg, foundGroup)
 			}
-			// assign to list
-			goCloakGroups = &gcg
 		}
+		// assign to list
+		goCloakGroups = &gcg
 	} else {
-		goCloakGroups, err = getGroupsForRealm(client, realm, token.AccessToken)
+		goCloakGroups, err = getGroupsForRealm(ctx, client, realm, accessToken)
 		if err != nil {
-			logoutErr := logoutKeyCloak(client, realm, token)
-			if logoutErr != nil {
-				logrus.Warnf("realm %s | could not log out: %s", realm.Name, err)
-			}
 			return syncGroups, err
 		}
 	}
@@ -259,6 +459,9 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 		}
 	}
 
+	// set to false when the first request for subgroups reports that the server can't list them
+	subGroupsChecked, subGroupsSupported := false, true
+
 	// cycle through the groups in a way that allows groups to be added so that subgroups can be added and resolved
 	// without recursion
 	idx := 0
@@ -299,6 +502,8 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 			SubgroupSeparator: realm.SubgroupSeparator,
 			Source:            "realm:" + realm.Name,
 			Realms:            []string{realm.Name},
+			Sources:           []GroupSource{{Realm: realm.Name, URL: realmUrl(realm), ID: *keyCloakGroup.group.ID, Path: *keyCloakGroup.group.Path}},
+			SyncedAt:          syncedAt,
 			Users:             make(map[string]User),
 			Parent:            keyCloakGroup.parent,
 			Skipped:           skipped,
@@ -308,12 +513,35 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 		if alias, found := realm.Aliases[group.Name]; found {
 			group.Alias = alias
 		}
+		// the attributes of the group take precedence over the configuration
+		applyGroupAttributes(realm, &group, keyCloakGroup.group.Attributes)
+
+		// name the group with the template for the realm and then apply the name rules
+		if err := renderName(nameTemplate, realm, &group, keyCloakGroup.group.Attributes); err != nil {
+			return syncGroups, err
+		}
+		group.TemplatedName = normalizer.normalize(group.TemplatedName)
 
 		// if configured: add subgroups to the list of groups to process
-		if realm.Subgroups && keyCloakGroup.group.SubGroups != nil && len(*keyCloakGroup.group.SubGroups) > 0 {
-			for _, subgroup := range *keyCloakGroup.group.SubGroups {
+		if realm.Subgroups {
+			var subGroups []gocloak.Group
+			if keyCloakGroup.group.SubGroups != nil && len(*keyCloakGroup.group.SubGroups) > 0 {
+				// older versions of keycloak return the subgroups with the group
+				subGroups = *keyCloakGroup.group.SubGroups
+			} else if subGroupsSupported {
+				// newer versions need them to be requested page by page
+				subGroups, err = getSubGroups(ctx, client, realm, accessToken, group.Id)
+				if err == errSubGroupsUnsupported && !subGroupsChecked {
+					subGroupsSupported = false
+				} else if err != nil {
+					// the subgroups and their members would be missing and then pruned so the realm fails instead
+					return syncGroups, fmt.Errorf("could not get subgroups of group %s: %s", group.Path, err)
+				}
+				subGroupsChecked = true
+			}
+			for subIdx := range subGroups {
 				enhancedGroups = append(enhancedGroups, &keycloakEnhancedGroup{
-					group:  &subgroup,
+					group:  &subGroups[subIdx],
 					parent: &group,
 				})
 			}
@@ -324,38 +552,149 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 			finalName := group.FinalName()
 
 			// ensure that the final name does not exist in the list of blocked final
-			// names before adding to the map of returned groups
-			if _, found := notTheseNames[finalName]; !found {
+			// names and that the group rules select the group before adding to the
+			// map of returned groups
+			_, blocked := notTheseNames[finalName]
+			selected, rule := rules.selected(group.Path, finalName)
+			if attributeSelection, decided := attributeSelected(realm, &group, keyCloakGroup.group.Attributes); decided {
+				selected = attributeSelection
+				rule = "attribute " + realm.GroupAttributes.GetSyncAttribute()
+			}
+			if !blocked && !selected {
+				if len(rule) > 0 {
+					logrus.Debugf("realm %s | group %s excluded by rule %s", realm.Name, group.Path, rule)
+				} else {
+					logrus.Debugf("realm %s | group %s not included by any rule", realm.Name, group.Path)
+				}
+			}
+			if !blocked && selected && claimName(finalName, "group:"+group.Id, "group "+group.Path) {
+				if err := metadata.apply(&group, keyCloakGroup.group.Attributes); err != nil {
+					return syncGroups, fmt.Errorf("realm %s: %s", realm.Name, err)
+				}
 				syncGroups[finalName] = group
 			}
 		}
 	}
 
+	// roles are synchronized as groups named after the role, these are the role groups by final name
+	roleGroups := make(map[string]keycloakRoleGroup)
+	if !realm.Roles.IsEmpty() {
+		foundRoles, err := getRoleGroupsForRealm(ctx, client, realm, accessToken)
+		if err != nil {
+			return syncGroups, err
+		}
+		for _, roleGroup := range foundRoles {
+			group := Group{
+				Id:       roleGroup.role.id,
+				Changed:  true,
+				Name:     roleGroup.name,
+				Prefix:   realm.GroupPrefix,
+				Suffix:   realm.GroupSuffix,
+				Source:   "role:" + realm.Name,
+				Realms:   []string{realm.Name},
+				Sources:  []GroupSource{{Realm: realm.Name, URL: realmUrl(realm), ID: roleGroup.role.id, Role: roleGroup.name}},
+				SyncedAt: syncedAt,
+				Users:    make(map[string]User),
+			}
+			if alias, found := realm.Aliases[group.Name]; found {
+				group.Alias = alias
+			}
+			if err := renderName(nameTemplate, realm, &group, roleGroup.attributes); err != nil {
+				return syncGroups, err
+			}
+			group.TemplatedName = normalizer.normalize(group.TemplatedName)
+
+			finalName := group.FinalName()
+			if _, found := notTheseNames[finalName]; found {
+				continue
+			}
+			if _, found := syncGroups[finalName]; found {
+				logrus.Warnf("realm %s | role %s has the same name as a group, skipping the role", realm.Name, roleGroup.name)
+				continue
+			}
+			if !claimName(finalName, "role:"+roleGroup.role.id, "role "+roleGroup.name) {
+				continue
+			}
+			if err := metadata.apply(&group, roleGroup.attributes); err != nil {
+				return syncGroups, fmt.Errorf("realm %s: %s", realm.Name, err)
+			}
+			syncGroups[finalName] = group
+			roleGroups[finalName] = roleGroup
+		}
+	}
+
+	// stop before any members are requested if any group can't be named
+	if len(nameProblems) > 0 {
+		return syncGroups, fmt.Errorf("%d group name(s) can't be used in OpenShift:\n  %s", len(nameProblems), strings.Join(nameProblems, "\n  "))
+	}
+
+	// keep track of users that could not be resolved to a name or were filtered so that they are only reported once
+	unresolvedUsers := make(map[string]bool)
+	filteredUsers := make(map[string]bool)
+
+	// fetch the members of each group concurrently, the results are stored by the index of the sorted group
+	// names so that they are applied in the same order every time
+	groupNames := make([]string, 0, len(syncGroups))
+	for groupName := range syncGroups {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	members := make([][]*gocloak.User, len(groupNames))
+	memberErrors := make([]error, len(groupNames))
+	// groups that could not be read are reported together, the realm is not complete without them
+	memberProblems := make([]string, 0)
+	runWorkers(realm.GetWorkers(), len(groupNames), func(idx int) {
+		if roleGroup, found := roleGroups[groupNames[idx]]; found {
+			members[idx], memberErrors[idx] = getUsersForRole(ctx, client, realm, roleGroup, accessToken)
+			return
+		}
+		members[idx], memberErrors[idx] = getUsersForGroup(ctx, client, realm, syncGroups[groupNames[idx]], accessToken)
+	})
+
 	// establish the users that belong to the group
-	for _, group := range syncGroups {
-		usersInGroup, err := getUsersForGroup(client, realm, group, token.AccessToken)
+	for idx, groupName := range groupNames {
+		group := syncGroups[groupName]
+		usersInGroup, err := members[idx], memberErrors[idx]
 		if err != nil {
-			logrus.Errorf("%s", err)
+			memberProblems = append(memberProblems, fmt.Sprintf("group %s: %s", groupName, err))
 			continue
 		}
 		for _, userInGroup := range usersInGroup {
-			// skip null user/usernames, we could log here but this really shouldn't happen
-			if userInGroup == nil || userInGroup.Username == nil {
+			// skip null users, we could log here but this really shouldn't happen
+			if userInGroup == nil || userInGroup.ID == nil {
+				continue
+			}
+			// skip users that are removed by the member filters
+			if reason, skip := filter.filtered(userInGroup); skip {
+				if _, reported := filteredUsers[*userInGroup.ID]; !reported {
+					filteredUsers[*userInGroup.ID] = true
+					logrus.Debugf("realm %s | user %s filtered: %s", realm.Name, describeUser(userInGroup), reason)
+				}
+				continue
+			}
+			// resolve the name of the user as it will be seen in openshift
+			userName, resolved := resolveUsername(realm.PreferredUsername, userInGroup)
+			if !resolved {
+				if _, reported := unresolvedUsers[*userInGroup.ID]; !reported {
+					unresolvedUsers[*userInGroup.ID] = true
+					logrus.Warnf("realm %s | user %s could not be resolved from preferred-username %v, skipping", realm.Name, describeUser(userInGroup), realm.PreferredUsername)
+				}
 				continue
 			}
 			// add user to group map
-			group.Users[*userInGroup.Username] = User{
+			group.Users[userName] = User{
 				Id:   *userInGroup.ID,
-				Name: *userInGroup.Username,
+				Name: userName,
 			}
 			if realm.SubgroupUsers {
 				// recursively add user to all parent groups
 				parentGroup := group.Parent
 				for parentGroup != nil {
-					if _, found := parentGroup.Users[*userInGroup.Username]; !found {
-						parentGroup.Users[*userInGroup.Username] = User{
+					if _, found := parentGroup.Users[userName]; !found {
+						parentGroup.Users[userName] = User{
 							Id:   *userInGroup.ID,
-							Name: *userInGroup.Username,
+							Name: userName,
+							Via:  group.Path,
 						}
 					}
 					parentGroup = parentGroup.Parent
@@ -364,33 +703,99 @@ func getGroupsAndUsersForRealm(realm RealmConfig) (map[string]Group, error) {
 		}
 	}
 
-	err = logoutKeyCloak(client, realm, token)
-	if err != nil {
-		logrus.Warnf("realm %s | could not log out: %s", realm.Name, err)
+	if len(filteredUsers) > 0 {
+		logrus.Debugf("realm %s | %d user(s) removed by the member filters", realm.Name, len(filteredUsers))
+	}
+	if len(unresolvedUsers) > 0 {
+		logrus.Warnf("realm %s | %d user(s) skipped because no preferred-username value could be resolved", realm.Name, len(unresolvedUsers))
+	}
+
+	// a group without its members would have all of its users pruned so the realm fails instead
+	if len(memberProblems) > 0 {
+		return syncGroups, fmt.Errorf("the members of %d group(s) could not be read:\n  %s", len(memberProblems), strings.Join(memberProblems, "\n  "))
 	}
 
 	return syncGroups, nil
 }
 
 func GetKeycloakGroupsFromRealm(realm RealmConfig) (GroupList, error) {
-	groupsForRealm, err := getGroupsAndUsersForRealm(realm)
-	if err != nil {
-		return groupsForRealm, err
+	sessions := NewKeycloakSessions()
+	defer sessions.Close()
+	return sessions.GetKeycloakGroupsFromRealm(context.Background(), realm)
+}
+
+/**
+ * GetKeycloakGroupsFromRealm gets the groups for the realm using the session that is open for the realm, the
+ *                            requests are stopped when the context is cancelled
+ */
+func (sessions *KeycloakSessions) GetKeycloakGroupsFromRealm(ctx context.Context, realm RealmConfig) (GroupList, error) {
+	start := time.Now()
+	groupsForRealm, err := getGroupsAndUsersForRealm(ctx, sessions.get(realm))
+	// a realm without groups was read and is not a failure, its groups are pruned like any other removed group
+	if err == nil && len(groupsForRealm) < 1 {
+		logrus.Infof("realm %s | no groups found", realm.Name)
 	}
-	if len(groupsForRealm) < 1 {
-		return groupsForRealm, errors.New("no groups returned for realm")
+
+	// count distinct users across all groups for metrics
+	users := make(map[string]bool)
+	for _, group := range groupsForRealm {
+		for userName := range group.Users {
+			users[userName] = true
+		}
 	}
-	return groupsForRealm, nil
+	metrics.ObserveRealmSync(realm.Name, time.Since(start), err, len(groupsForRealm), len(users))
+
+	return groupsForRealm, err
 }
 
 func GetKeycloakGroups(syncConfig Config) (map[string]Group, error) {
-	groupList := GroupList{}
-	for _, realm := range syncConfig.Realms {
-		groupsForRealm, err := GetKeycloakGroupsFromRealm(realm)
-		if err != nil {
-			return nil, err
+	sessions := NewKeycloakSessions()
+	defer sessions.Close()
+	return sessions.GetKeycloakGroups(context.Background(), syncConfig)
+}
+
+/**
+ * GetKeycloakGroups gets the groups for every configured realm using the sessions that are open for the realms,
+ *                   the requests are stopped when the context is cancelled
+ */
+func (sessions *KeycloakSessions) GetKeycloakGroups(ctx context.Context, syncConfig Config) (GroupList, error) {
+	// get the groups for each realm concurrently, results are stored by realm index
+	realmGroups := make([]GroupList, len(syncConfig.Realms))
+	realmErrors := make([]error, len(syncConfig.Realms))
+	runWorkers(syncConfig.GetWorkers(), len(syncConfig.Realms), func(idx int) {
+		realmGroups[idx], realmErrors[idx] = sessions.GetKeycloakGroupsFromRealm(ctx, syncConfig.Realms[idx])
+	})
+
+	// a required realm that failed stops the sync but optional realms are left out and reported at the end
+	var partial *PartialSyncError
+	for idx, realm := range syncConfig.Realms {
+		if realmErrors[idx] == nil {
+			continue
 		}
-		groupList = Merge(groupList, groupsForRealm)
+		if !realm.Optional {
+			return nil, realmErrors[idx]
+		}
+		logrus.Warnf("realm %s | could not be read, groups from the realm will not be changed: %s", realm.Name, realmErrors[idx])
+		if partial == nil {
+			partial = &PartialSyncError{}
+		}
+		partial.Failures = append(partial.Failures, RealmFailure{Realm: realm.Name, Err: realmErrors[idx]})
+		realmGroups[idx] = GroupList{}
+	}
+
+	// merge in the order the realms are configured so that the output does not depend on which realm finished first
+	groupList, conflicts, err := MergeRealms(syncConfig, realmGroups)
+	for _, conflict := range conflicts {
+		logrus.Infof("%s", conflict)
+	}
+	if len(conflicts) > 0 {
+		logrus.Infof("Resolved %d group conflict(s) between realms", len(conflicts))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if partial != nil {
+		return groupList, partial
 	}
 	return groupList, nil
 }
@@ -0,0 +1,624 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+/**
+ * fakeKeycloak is a minimal stand-in for the parts of the keycloak api that keycloak-sync uses. it serves
+ *              a single realm and honors the first/max pagination parameters so that tests can prove that
+ *              more than one page is collected.
+ */
+type fakeKeycloak struct {
+	t      *testing.T
+	server *httptest.Server
+	realm  string
+
+	// top level groups, subgroups are inline unless children is set
+	groups []*gocloak.Group
+	// when not nil subgroups are served from the children endpoint by parent group id
+	children map[string][]gocloak.Group
+	// parent group id -> status code that the children endpoint answers with instead of the children
+	childrenStatus map[string]int
+	// group id -> members
+	members map[string][]*gocloak.User
+
+	// realm roles, client ids to the internal id of the client, and internal client id -> client roles
+	roles       []*gocloak.Role
+	clients     map[string]string
+	clientRoles map[string][]*gocloak.Role
+	// role id -> composites of the role, users with the role, and groups with the role
+	composites map[string][]*gocloak.Role
+	roleUsers  map[string][]*gocloak.User
+	roleGroups map[string][]*gocloak.Group
+	// role name -> status code that the role endpoint answers with instead of the role
+	roleStatus map[string]int
+
+	// when set the token endpoint only gives a token when this returns nil
+	tokenCheck func(r *http.Request) error
+	// when set the members endpoint waits this long (or until the request is cancelled) before answering
+	membersDelay time.Duration
+
+	// count of requests by a short description of the endpoint
+	mutex    gosync.Mutex
+	requests map[string]int
+}
+
+func newFakeKeycloak(t *testing.T) *fakeKeycloak {
+	fake := newUnstartedFakeKeycloak(t)
+	fake.server.Start()
+	return fake
+}
+
+/**
+ * newUnstartedFakeKeycloak returns a fake with a server that is not started so that its tls settings can be
+ *                          changed first
+ */
+func newUnstartedFakeKeycloak(t *testing.T) *fakeKeycloak {
+	fake := &fakeKeycloak{
+		t:        t,
+		realm:    "sso",
+		groups:   make([]*gocloak.Group, 0),
+		members:  make(map[string][]*gocloak.User),
+		requests: make(map[string]int),
+
+		roles:       make([]*gocloak.Role, 0),
+		clients:     make(map[string]string),
+		clientRoles: make(map[string][]*gocloak.Role),
+		composites:  make(map[string][]*gocloak.Role),
+		roleUsers:   make(map[string][]*gocloak.User),
+		roleGroups:  make(map[string][]*gocloak.Group),
+	}
+	fake.server = httptest.NewUnstartedServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (fake *fakeKeycloak) realmConfig() RealmConfig {
+	return RealmConfig{
+		Name:      fake.realm,
+		Url:       fake.server.URL,
+		SslVerify: true,
+		ClientConfig: &ClientConfig{
+			ClientId:     "client",
+			ClientSecret: "secret",
+		},
+	}
+}
+
+func (fake *fakeKeycloak) count(endpoint string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.requests[endpoint]
+}
+
+func (fake *fakeKeycloak) record(endpoint string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.requests[endpoint]++
+}
+
+func (fake *fakeKeycloak) handle(w http.ResponseWriter, r *http.Request) {
+	realmPrefix := "/auth/realms/" + fake.realm + "/protocol/openid-connect/"
+	adminPrefix := "/auth/admin/realms/" + fake.realm + "/"
+
+	switch {
+	case r.URL.Path == realmPrefix+"token":
+		fake.record("token")
+		if fake.tokenCheck != nil {
+			if err := fake.tokenCheck(r); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				fake.writeJSON(w, map[string]interface{}{"error": "unauthorized_client", "error_description": err.Error()})
+				return
+			}
+		}
+		fake.writeJSON(w, map[string]interface{}{
+			"access_token":  "access",
+			"refresh_token": "refresh",
+			"expires_in":    300,
+			"session_state": "session",
+		})
+	case r.URL.Path == realmPrefix+"token/introspect":
+		fake.record("introspect")
+		fake.writeJSON(w, map[string]interface{}{"active": true})
+	case r.URL.Path == realmPrefix+"logout":
+		fake.record("logout")
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, adminPrefix+"groups"):
+		fake.handleGroups(w, r, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix+"groups"), "/"), "/"))
+	case strings.HasPrefix(r.URL.Path, adminPrefix+"roles-by-id/"):
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminPrefix+"roles-by-id/"), "/")
+		if len(parts) != 2 || parts[1] != "composites" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fake.record("composites")
+		fake.writeJSON(w, fake.composites[parts[0]])
+	case strings.HasPrefix(r.URL.Path, adminPrefix+"roles"):
+		fake.handleRoles(w, r, fake.roles, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix+"roles"), "/"), "/"))
+	case strings.HasPrefix(r.URL.Path, adminPrefix+"clients"):
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix+"clients"), "/"), "/")
+		if len(parts) == 1 && parts[0] == "" {
+			fake.record("clients")
+			clientId := r.URL.Query().Get("clientId")
+			found := make([]gocloak.Client, 0)
+			if id, exists := fake.clients[clientId]; exists {
+				found = append(found, gocloak.Client{ID: gocloak.StringP(id), ClientID: gocloak.StringP(clientId)})
+			}
+			fake.writeJSON(w, found)
+			return
+		}
+		if len(parts) < 2 || parts[1] != "roles" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fake.handleRoles(w, r, fake.clientRoles[parts[0]], parts[2:])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (fake *fakeKeycloak) handleGroups(w http.ResponseWriter, r *http.Request, parts []string) {
+	first, max := fake.page(r)
+
+	// top level groups
+	if len(parts) == 1 && parts[0] == "" {
+		fake.record("groups")
+		search := r.URL.Query().Get("search")
+		found := make([]*gocloak.Group, 0)
+		for _, group := range fake.groups {
+			if len(search) < 1 || fake.groupTreeContains(*group, search) {
+				found = append(found, group)
+			}
+		}
+		fake.writeJSON(w, pageOf(len(found), first, max, func(idx int) interface{} { return fake.represent(r, *found[idx]) }))
+		return
+	}
+
+	// a single group with its subgroups inline
+	if len(parts) == 1 {
+		fake.record("group")
+		for _, group := range fake.groups {
+			if found := findGroup(*group, parts[0]); found != nil {
+				fake.writeJSON(w, found)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "members" {
+		fake.record("members")
+		if fake.membersDelay > 0 {
+			select {
+			case <-time.After(fake.membersDelay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		members := fake.members[parts[0]]
+		fake.writeJSON(w, pageOf(len(members), first, max, func(idx int) interface{} { return members[idx] }))
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "children" {
+		fake.record("children")
+		if fake.children == nil {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if status, found := fake.childrenStatus[parts[0]]; found {
+			w.WriteHeader(status)
+			return
+		}
+		children := fake.children[parts[0]]
+		fake.writeJSON(w, pageOf(len(children), first, max, func(idx int) interface{} { return fake.represent(r, children[idx]) }))
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+/**
+ * represent leaves the attributes out of a listed group (and its subgroups) unless the full representation is
+ *           requested, the same as keycloak
+ */
+func (fake *fakeKeycloak) represent(r *http.Request, group gocloak.Group) gocloak.Group {
+	if r.URL.Query().Get("briefRepresentation") == "false" {
+		return group
+	}
+	group.Attributes = nil
+	if group.SubGroups != nil {
+		subGroups := make([]gocloak.Group, 0, len(*group.SubGroups))
+		for _, subGroup := range *group.SubGroups {
+			subGroups = append(subGroups, fake.represent(r, subGroup))
+		}
+		group.SubGroups = &subGroups
+	}
+	return group
+}
+
+func (fake *fakeKeycloak) handleRoles(w http.ResponseWriter, r *http.Request, roles []*gocloak.Role, parts []string) {
+	first, max := fake.page(r)
+
+	// all roles
+	if len(parts) == 0 || (len(parts) == 1 && parts[0] == "") {
+		fake.record("roles")
+		fake.writeJSON(w, roles)
+		return
+	}
+
+	if status, found := fake.roleStatus[parts[0]]; found {
+		w.WriteHeader(status)
+		return
+	}
+
+	var role *gocloak.Role
+	for _, candidate := range roles {
+		if *candidate.Name == parts[0] {
+			role = candidate
+		}
+	}
+	if role == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		fake.record("role")
+		fake.writeJSON(w, role)
+	case len(parts) == 2 && parts[1] == "users":
+		fake.record("role-users")
+		users := fake.roleUsers[*role.ID]
+		fake.writeJSON(w, pageOf(len(users), first, max, func(idx int) interface{} { return users[idx] }))
+	case len(parts) == 2 && parts[1] == "groups":
+		fake.record("role-groups")
+		groups := fake.roleGroups[*role.ID]
+		fake.writeJSON(w, pageOf(len(groups), first, max, func(idx int) interface{} { return groups[idx] }))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (fake *fakeKeycloak) page(r *http.Request) (int, int) {
+	first, err := strconv.Atoi(r.URL.Query().Get("first"))
+	if err != nil {
+		first = 0
+	}
+	max, err := strconv.Atoi(r.URL.Query().Get("max"))
+	if err != nil {
+		// mimic the keycloak default page size
+		max = 100
+	}
+	return first, max
+}
+
+func (fake *fakeKeycloak) writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		fake.t.Errorf("could not write fake keycloak response: %s", err)
+	}
+}
+
+func pageOf(total int, first int, max int, item func(idx int) interface{}) []interface{} {
+	output := make([]interface{}, 0)
+	for idx := first; idx < total && idx < first+max; idx++ {
+		output = append(output, item(idx))
+	}
+	return output
+}
+
+// groupTreeContains is true when the name of the group or any group below it (inline or served as children) has the search
+func (fake *fakeKeycloak) groupTreeContains(group gocloak.Group, search string) bool {
+	if group.Name != nil && strings.Contains(*group.Name, search) {
+		return true
+	}
+	subGroups := make([]gocloak.Group, 0)
+	if group.SubGroups != nil {
+		subGroups = append(subGroups, *group.SubGroups...)
+	}
+	if group.ID != nil {
+		subGroups = append(subGroups, fake.children[*group.ID]...)
+	}
+	for _, subGroup := range subGroups {
+		if fake.groupTreeContains(subGroup, search) {
+			return true
+		}
+	}
+	return false
+}
+
+func findGroup(group gocloak.Group, id string) *gocloak.Group {
+	if group.ID != nil && *group.ID == id {
+		return &group
+	}
+	if group.SubGroups != nil {
+		for _, subGroup := range *group.SubGroups {
+			if found := findGroup(subGroup, id); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+func fakeGroup(name string, parentPath string, subGroups ...gocloak.Group) gocloak.Group {
+	id := "id" + strings.ReplaceAll(parentPath+"/"+name, "/", "-")
+	path := parentPath + "/" + name
+	return gocloak.Group{
+		ID:        &id,
+		Name:      &name,
+		Path:      &path,
+		SubGroups: &subGroups,
+	}
+}
+
+func fakeUsers(prefix string, count int) []*gocloak.User {
+	users := make([]*gocloak.User, 0, count)
+	for idx := 0; idx < count; idx++ {
+		id := fmt.Sprintf("%s-id-%d", prefix, idx)
+		username := fmt.Sprintf("%s%d", prefix, idx)
+		users = append(users, &gocloak.User{
+			ID:       &id,
+			Username: &username,
+		})
+	}
+	return users
+}
+
+func TestGetGroupsForRealmPaginates(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	for idx := 0; idx < 25; idx++ {
+		group := fakeGroup(fmt.Sprintf("group%d", idx), "")
+		fake.groups = append(fake.groups, &group)
+	}
+
+	realm := fake.realmConfig()
+	realm.PageSize = 10
+
+	groups, err := getGroupsForRealm(context.Background(), gocloak.NewClient(realm.Url), realm, "access")
+	a.Nil(err)
+	a.Equal(25, len(*groups))
+	a.Equal(3, fake.count("groups"))
+}
+
+func TestGetUsersForGroupPaginates(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	fake.members["all-employees"] = fakeUsers("user", 4000)
+
+	// use the default page size
+	realm := fake.realmConfig()
+
+	users, err := getUsersForGroup(context.Background(), gocloak.NewClient(realm.Url), realm, Group{Id: "all-employees", Name: "all-employees"}, "access")
+	a.Nil(err)
+	a.Equal(4000, len(users))
+	a.Equal(41, fake.count("members"))
+}
+
+func TestGetSubGroupsPaginates(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	fake.children = map[string][]gocloak.Group{}
+	for idx := 0; idx < 12; idx++ {
+		fake.children["parent"] = append(fake.children["parent"], fakeGroup(fmt.Sprintf("child%d", idx), "/parent"))
+	}
+
+	realm := fake.realmConfig()
+	realm.PageSize = 5
+
+	subGroups, err := getSubGroups(context.Background(), gocloak.NewClient(realm.Url), realm, "access", "parent")
+	a.Nil(err)
+	a.Equal(12, len(subGroups))
+	a.Equal(3, fake.count("children"))
+}
+
+func TestGetSubGroupsUnsupported(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	realm := fake.realmConfig()
+
+	_, err := getSubGroups(context.Background(), gocloak.NewClient(realm.Url), realm, "access", "parent")
+	a.Equal(errSubGroupsUnsupported, err)
+}
+
+func TestGetGroupsAndUsersForRealmPaginates(t *testing.T) {
+	a := assert.New(t)
+
+	// top level groups have no inline subgroups and the children are served separately
+	fake := newFakeKeycloak(t)
+	fake.children = map[string][]gocloak.Group{}
+	for idx := 0; idx < 7; idx++ {
+		group := fakeGroup(fmt.Sprintf("team%d", idx), "")
+		fake.groups = append(fake.groups, &group)
+		fake.members[*group.ID] = fakeUsers(fmt.Sprintf("team%d-user", idx), 6)
+		child := fakeGroup("admins", *group.Path)
+		fake.children[*group.ID] = []gocloak.Group{child}
+		fake.members[*child.ID] = fakeUsers(fmt.Sprintf("team%d-admin", idx), 4)
+	}
+
+	realm := fake.realmConfig()
+	realm.PageSize = 3
+	realm.Subgroups = true
+	realm.SubgroupConcat = true
+	realm.SubgroupUsers = true
+
+	session := newKeycloakSession(realm)
+	defer session.close()
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+	a.Equal(14, len(groups))
+	a.Equal(10, len(groups["team3"].Users))
+	a.Equal(4, len(groups["team3.admins"].Users))
+}
+
+func TestGetGroupsAndUsersForRealmSubGroupErrors(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	fake.children = map[string][]gocloak.Group{}
+	for idx := 0; idx < 3; idx++ {
+		group := fakeGroup(fmt.Sprintf("team%d", idx), "")
+		fake.groups = append(fake.groups, &group)
+		fake.children[*group.ID] = []gocloak.Group{fakeGroup("admins", *group.Path)}
+	}
+
+	realm := fake.realmConfig()
+	realm.Subgroups = true
+	realm.SubgroupConcat = true
+	collect := func() (GroupList, error) {
+		session := newKeycloakSession(realm)
+		defer session.close()
+		return getGroupsAndUsersForRealm(context.Background(), session)
+	}
+
+	// a server error fails the realm instead of leaving out the subgroups
+	fake.childrenStatus = map[string]int{"id-team1": http.StatusInternalServerError}
+	_, err := collect()
+	a.Error(err)
+	a.Contains(err.Error(), "could not get subgroups of group /team1")
+
+	// a 404 after the server has listed subgroups is a missing group and not an unsupported endpoint
+	fake.childrenStatus = map[string]int{"id-team1": http.StatusNotFound}
+	_, err = collect()
+	a.Error(err)
+
+	// a 404 on the first request means the server can't list subgroups and it is not asked again
+	fake.childrenStatus = map[string]int{"id-team0": http.StatusNotFound}
+	before := fake.count("children")
+	groups, err := collect()
+	a.Nil(err)
+	a.Equal(3, len(groups))
+	a.Equal(1, fake.count("children")-before)
+}
+
+func TestGetGroupsByNamePaginates(t *testing.T) {
+	a := assert.New(t)
+
+	// every top level group has a "stage" subgroup so the search matches all of them
+	fake := newFakeKeycloak(t)
+	for idx := 0; idx < 9; idx++ {
+		name := fmt.Sprintf("team%d", idx)
+		group := fakeGroup(name, "", fakeGroup("stage", "/"+name))
+		fake.groups = append(fake.groups, &group)
+	}
+
+	realm := fake.realmConfig()
+	realm.PageSize = 4
+
+	groups, err := getGroupsByName(context.Background(), gocloak.NewClient(realm.Url), realm, "access", "stage")
+	a.Nil(err)
+	a.Equal(9, len(*groups))
+	a.Equal(3, fake.count("groups"))
+	a.Equal("/team8/stage", *(*groups)[8].Path)
+}
+
+func TestGetGroupsByNameChildren(t *testing.T) {
+	a := assert.New(t)
+
+	// the groups have no inline subgroups and "stage" is past the first page of children of each group
+	fake := newFakeKeycloak(t)
+	fake.children = map[string][]gocloak.Group{}
+	for idx := 0; idx < 3; idx++ {
+		name := fmt.Sprintf("team%d", idx)
+		group := fakeGroup(name, "")
+		fake.groups = append(fake.groups, &group)
+		fake.children[*group.ID] = []gocloak.Group{fakeGroup("dev", "/"+name), fakeGroup("qa", "/"+name), fakeGroup("stage", "/"+name)}
+	}
+	// and a deeper "stage" below a child that is also only found from the children endpoint
+	fake.children["id-team0-qa"] = []gocloak.Group{fakeGroup("stage", "/team0/qa")}
+
+	realm := fake.realmConfig()
+	realm.PageSize = 2
+
+	groups, err := getGroupsByName(context.Background(), gocloak.NewClient(realm.Url), realm, "access", "stage")
+	a.Nil(err)
+	paths := make([]string, 0)
+	for _, group := range *groups {
+		paths = append(paths, *group.Path)
+	}
+	a.ElementsMatch([]string{"/team0/stage", "/team0/qa/stage", "/team1/stage", "/team2/stage"}, paths)
+}
+
+func TestGetGroupsAndUsersForRealmGroupNames(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	fake.children = map[string][]gocloak.Group{}
+	team := fakeGroup("team", "")
+	fake.groups = append(fake.groups, &team)
+	fake.children[*team.ID] = []gocloak.Group{fakeGroup("stage", "/team")}
+
+	realm := fake.realmConfig()
+	collect := func(names ...string) (GroupList, error) {
+		realm.Groups = names
+		session := newKeycloakSession(realm)
+		defer session.close()
+		return getGroupsAndUsersForRealm(context.Background(), session)
+	}
+
+	groups, err := collect("stage", "missing")
+	a.Nil(err)
+	a.Equal(1, len(groups))
+
+	// a group that is not found (or no name at all) is not an error
+	groups, err = collect("missing")
+	a.Nil(err)
+	a.Empty(groups)
+	groups, err = collect("")
+	a.Nil(err)
+	a.Empty(groups)
+
+	// but a group that can't be read fails the realm instead of looking like it was removed from keycloak
+	fake.childrenStatus = map[string]int{*team.ID: http.StatusServiceUnavailable}
+	_, err = collect("stage")
+	a.Error(err)
+	a.Contains(err.Error(), "could not get group named stage")
+}
+
+func TestGetKeycloakGroupsMergesInRealmOrder(t *testing.T) {
+	a := assert.New(t)
+
+	// three realms that all have the same group so that the merged realm list shows the merge order
+	config := Config{
+		Workers: 3,
+	}
+	for _, realmName := range []string{"first", "second", "third"} {
+		fake := newFakeKeycloak(t)
+		fake.realm = realmName
+		group := fakeGroup("shared", "")
+		fake.groups = append(fake.groups, &group)
+		fake.members[*group.ID] = fakeUsers(realmName, 150)
+
+		realm := fake.realmConfig()
+		realm.Workers = 2
+		config.Realms = append(config.Realms, realm)
+	}
+
+	for run := 0; run < 5; run++ {
+		groups, err := GetKeycloakGroups(config)
+		a.Nil(err)
+		a.Equal(1, len(groups))
+		a.Equal([]string{"first", "second", "third"}, groups["shared"].Realms)
+		a.Equal(450, len(groups["shared"].Users))
+	}
+}
@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/Nerzal/gocloak/v7"
+	"regexp"
+	"strings"
+)
+
+// keycloak creates a user with this prefix for each client that has service accounts enabled
+const serviceAccountPrefix = "service-account-"
+
+/**
+ * memberFilter is the compiled form of the member filters for a realm
+ */
+type memberFilter struct {
+	config MemberFilterConfig
+	// compiled regular expressions by the index of the attribute filter, nil for equality filters
+	patterns []*regexp.Regexp
+}
+
+func newMemberFilter(config MemberFilterConfig) (*memberFilter, error) {
+	filter := &memberFilter{
+		config:   config,
+		patterns: make([]*regexp.Regexp, len(config.Attributes)),
+	}
+	for idx, attribute := range config.Attributes {
+		if len(attribute.Regex) < 1 {
+			continue
+		}
+		pattern, err := regexp.Compile(attribute.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for attribute %s: %s", attribute.Name, err)
+		}
+		filter.patterns[idx] = pattern
+	}
+	return filter, nil
+}
+
+/**
+ * filtered returns true and the reason when the user should not be added to any group
+ */
+func (filter *memberFilter) filtered(user *gocloak.User) (string, bool) {
+	if filter.config.SkipDisabled && user.Enabled != nil && !*user.Enabled {
+		return "disabled", true
+	}
+	if filter.config.RequireEmailVerified && (user.EmailVerified == nil || !*user.EmailVerified) {
+		return "email not verified", true
+	}
+	if filter.config.SkipServiceAccounts && isServiceAccount(user) {
+		return "service account", true
+	}
+	for idx, attribute := range filter.config.Attributes {
+		if !filter.matches(idx, attributeValues(attribute.Name, user)) {
+			if filter.patterns[idx] != nil {
+				return fmt.Sprintf("attribute %s does not match %s", attribute.Name, attribute.Regex), true
+			}
+			return fmt.Sprintf("attribute %s is not %s", attribute.Name, attribute.Equals), true
+		}
+	}
+	return "", false
+}
+
+func (filter *memberFilter) matches(idx int, values []string) bool {
+	for _, value := range values {
+		if pattern := filter.patterns[idx]; pattern != nil {
+			if pattern.MatchString(value) {
+				return true
+			}
+		} else if value == filter.config.Attributes[idx].Equals {
+			return true
+		}
+	}
+	return false
+}
+
+func isServiceAccount(user *gocloak.User) bool {
+	if user.ServiceAccountClientID != nil && len(*user.ServiceAccountClientID) > 0 {
+		return true
+	}
+	return user.Username != nil && strings.HasPrefix(*user.Username, serviceAccountPrefix)
+}
+
+/**
+ * attributeValues returns the values of a built in field or a user attribute with the given name
+ */
+func attributeValues(name string, user *gocloak.User) []string {
+	if field, found := builtInUsernameFields[strings.ToLower(strings.TrimSpace(name))]; found {
+		if value := field(user); value != nil {
+			return []string{*value}
+		}
+		return []string{}
+	}
+	if user.Attributes == nil {
+		return []string{}
+	}
+	return (*user.Attributes)[name]
+}
@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"context"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func filterTestUser(username string) *gocloak.User {
+	return &gocloak.User{
+		ID:            gocloak.StringP(username + "-id"),
+		Username:      gocloak.StringP(username),
+		Email:         gocloak.StringP(username + "@example.com"),
+		Enabled:       gocloak.BoolP(true),
+		EmailVerified: gocloak.BoolP(true),
+		Attributes: &map[string][]string{
+			"department": {"sales", "engineering"},
+		},
+	}
+}
+
+func TestMemberFilterFlags(t *testing.T) {
+	a := assert.New(t)
+
+	filter, err := newMemberFilter(MemberFilterConfig{
+		SkipDisabled:         true,
+		RequireEmailVerified: true,
+		SkipServiceAccounts:  true,
+	})
+	a.Nil(err)
+
+	user := filterTestUser("alice")
+	_, skip := filter.filtered(user)
+	a.False(skip)
+
+	user.Enabled = gocloak.BoolP(false)
+	reason, skip := filter.filtered(user)
+	a.True(skip)
+	a.Equal("disabled", reason)
+
+	user = filterTestUser("bob")
+	user.EmailVerified = nil
+	reason, skip = filter.filtered(user)
+	a.True(skip)
+	a.Equal("email not verified", reason)
+
+	user = filterTestUser("service-account-sync-client")
+	reason, skip = filter.filtered(user)
+	a.True(skip)
+	a.Equal("service account", reason)
+
+	// nothing is filtered without configuration
+	filter, err = newMemberFilter(MemberFilterConfig{})
+	a.Nil(err)
+	user.Enabled = gocloak.BoolP(false)
+	_, skip = filter.filtered(user)
+	a.False(skip)
+}
+
+func TestMemberFilterAttributes(t *testing.T) {
+	a := assert.New(t)
+
+	filter, err := newMemberFilter(MemberFilterConfig{
+		Attributes: []AttributeFilterConfig{
+			{Name: "department", Equals: "engineering"},
+			{Name: "email", Regex: "@example\\.com$"},
+		},
+	})
+	a.Nil(err)
+
+	_, skip := filter.filtered(filterTestUser("alice"))
+	a.False(skip)
+
+	user := filterTestUser("bob")
+	user.Email = gocloak.StringP("bob@example.org")
+	reason, skip := filter.filtered(user)
+	a.True(skip)
+	a.Equal("attribute email does not match @example\\.com$", reason)
+
+	user = filterTestUser("carol")
+	user.Attributes = nil
+	reason, skip = filter.filtered(user)
+	a.True(skip)
+	a.Equal("attribute department is not engineering", reason)
+
+	_, err = newMemberFilter(MemberFilterConfig{
+		Attributes: []AttributeFilterConfig{{Name: "department", Regex: "("}},
+	})
+	a.Error(err)
+}
+
+func TestGetGroupsAndUsersForRealmFiltersMembers(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	disabled := filterTestUser("disabled")
+	disabled.Enabled = gocloak.BoolP(false)
+	fake.members[*group.ID] = []*gocloak.User{filterTestUser("alice"), disabled, filterTestUser("service-account-ci")}
+
+	realm := fake.realmConfig()
+	realm.MemberFilters = MemberFilterConfig{
+		SkipDisabled:        true,
+		SkipServiceAccounts: true,
+	}
+
+	session := newKeycloakSession(realm)
+	defer session.close()
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+	a.Equal(1, len(groups["developers"].Users))
+	a.Contains(groups["developers"].Users, "alice")
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/**
+ * MergeConflict records a group that was found in more than one realm and how the conflict was resolved
+ */
+type MergeConflict struct {
+	Group string
+	// the realms that the group was already found in and the realm that also has the group
+	Realms     []string
+	Realm      string
+	Strategy   string
+	Resolution string
+}
+
+func (conflict MergeConflict) String() string {
+	return fmt.Sprintf("group %s from realm %s was already found in realm(s) %s, %s: %s", conflict.Group, conflict.Realm, strings.Join(conflict.Realms, ", "), conflict.Strategy, conflict.Resolution)
+}
+
+/**
+ * MergeRealms merges the groups from each realm in the order that the realms are configured. the groups in
+ *             realmGroups must be in the same order as the realms in the configuration. when a group has the same
+ *             final name as a group from a realm that was merged before it the merge strategy for the group decides
+ *             which users are kept and every conflict is returned. conflicts that use the "error" strategy are all
+ *             collected before the error is returned.
+ */
+func MergeRealms(config Config, realmGroups []GroupList) (GroupList, []MergeConflict, error) {
+	output := GroupList{}
+	conflicts := make([]MergeConflict, 0)
+	failures := make([]string, 0)
+
+	// the priority of the realm that the group in the output is from, for unions it is the highest priority
+	priorities := make(map[string]int)
+
+	for idx, groups := range realmGroups {
+		realm := config.Realms[idx]
+
+		// go through the groups by name so that the conflicts are reported in the same order every time
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			group := groups[name].copy()
+			existing, found := output[name]
+			if !found {
+				output[name] = group
+				priorities[name] = realm.Priority
+				continue
+			}
+
+			conflict := MergeConflict{
+				Group:    name,
+				Realms:   append([]string{}, existing.Realms...),
+				Realm:    realm.Name,
+				Strategy: config.GetMergeStrategy(realm, name),
+			}
+			existingFrom := strings.Join(existing.Realms, ", ")
+
+			switch conflict.Strategy {
+			case MergeFirstWins:
+				conflict.Resolution = fmt.Sprintf("kept the group from %s", existingFrom)
+			case MergePriority:
+				if realm.Priority > priorities[name] {
+					conflict.Resolution = fmt.Sprintf("replaced the group from %s because priority %d is higher than %d", existingFrom, realm.Priority, priorities[name])
+					output[name] = group
+					priorities[name] = realm.Priority
+				} else {
+					conflict.Resolution = fmt.Sprintf("kept the group from %s because priority %d is not higher than %d", existingFrom, realm.Priority, priorities[name])
+				}
+			case MergeError:
+				conflict.Resolution = "stopped the sync"
+				failures = append(failures, fmt.Sprintf("%s (%s and %s)", name, existingFrom, realm.Name))
+			default:
+				added := unionGroup(&existing, group)
+				output[name] = existing
+				if realm.Priority > priorities[name] {
+					priorities[name] = realm.Priority
+				}
+				conflict.Resolution = fmt.Sprintf("added %d user(s) that were not already in the group", added)
+			}
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	if len(failures) > 0 {
+		return output, conflicts, fmt.Errorf("group(s) found in more than one realm: %s", strings.Join(failures, ", "))
+	}
+	return output, conflicts, nil
+}
+
+/**
+ * unionGroup adds the realms and users of the source group to the target group and returns the number of users
+ *            that were added
+ */
+func unionGroup(target *Group, source Group) int {
+	target.Realms = append(target.Realms, source.Realms...)
+	target.Sources = append(target.Sources, source.Sources...)
+	target.SyncedAt = latestSync(target.SyncedAt, source.SyncedAt)
+	// the realm that is merged first sets a label or annotation that more than one realm has
+	target.ManagedLabels = mergeMetadata(target.ManagedLabels, source.ManagedLabels)
+	target.ManagedAnnotations = mergeMetadata(target.ManagedAnnotations, source.ManagedAnnotations)
+	added := 0
+	for userName, user := range source.Users {
+		if _, found := target.Users[userName]; found {
+			continue
+		}
+		target.Users[userName] = user
+		added++
+	}
+	if added > 0 {
+		target.Changed = true
+	}
+	return added
+}
@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func realmGroup(realm string, name string, users ...string) Group {
+	group := Group{
+		Id:      realm + "-" + name,
+		Name:    name,
+		Source:  "realm:" + realm,
+		Realms:  []string{realm},
+		Users:   make(map[string]User),
+		Changed: true,
+	}
+	for _, user := range users {
+		group.Users[user] = User{Id: user, Name: user}
+	}
+	return group
+}
+
+func mergeTestConfig(strategy string) Config {
+	return Config{
+		MergeStrategy: strategy,
+		Realms: []RealmConfig{
+			{Name: "partner"},
+			{Name: "prod", Priority: 10},
+		},
+	}
+}
+
+func mergeTestGroups() []GroupList {
+	return []GroupList{
+		{
+			"admins":   realmGroup("partner", "admins", "alice", "mallory"),
+			"partners": realmGroup("partner", "partners", "mallory"),
+		},
+		{
+			"admins": realmGroup("prod", "admins", "alice", "bob"),
+		},
+	}
+}
+
+func userNames(group Group) []string {
+	names := make([]string, 0, len(group.Users))
+	for name := range group.Users {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMergeRealmsUnion(t *testing.T) {
+	a := assert.New(t)
+
+	merged, conflicts, err := MergeRealms(mergeTestConfig(""), mergeTestGroups())
+	a.Nil(err)
+	a.Len(merged, 2)
+	a.ElementsMatch([]string{"alice", "bob", "mallory"}, userNames(merged["admins"]))
+	a.Equal([]string{"partner", "prod"}, merged["admins"].Realms)
+
+	a.Len(conflicts, 1)
+	a.Equal("admins", conflicts[0].Group)
+	a.Equal("prod", conflicts[0].Realm)
+	a.Equal([]string{"partner"}, conflicts[0].Realms)
+	a.Equal(MergeUnion, conflicts[0].Strategy)
+	a.Contains(conflicts[0].String(), "added 1 user(s)")
+}
+
+func TestMergeRealmsFirstWins(t *testing.T) {
+	a := assert.New(t)
+
+	merged, conflicts, err := MergeRealms(mergeTestConfig(MergeFirstWins), mergeTestGroups())
+	a.Nil(err)
+	a.ElementsMatch([]string{"alice", "mallory"}, userNames(merged["admins"]))
+	a.Equal([]string{"partner"}, merged["admins"].Realms)
+	a.Len(conflicts, 1)
+	a.Equal(MergeFirstWins, conflicts[0].Strategy)
+}
+
+func TestMergeRealmsPriority(t *testing.T) {
+	a := assert.New(t)
+
+	// the prod realm has the higher priority so it replaces the group even though it is merged last
+	merged, conflicts, err := MergeRealms(mergeTestConfig(MergePriority), mergeTestGroups())
+	a.Nil(err)
+	a.ElementsMatch([]string{"alice", "bob"}, userNames(merged["admins"]))
+	a.Equal([]string{"prod"}, merged["admins"].Realms)
+	// groups that are only in one realm are not affected
+	a.ElementsMatch([]string{"mallory"}, userNames(merged["partners"]))
+	a.Len(conflicts, 1)
+	a.Contains(conflicts[0].Resolution, "replaced")
+
+	// the realm with the lower priority does not replace the group
+	config := mergeTestConfig(MergePriority)
+	config.Realms[0].Priority = 20
+	merged, _, err = MergeRealms(config, mergeTestGroups())
+	a.Nil(err)
+	a.ElementsMatch([]string{"alice", "mallory"}, userNames(merged["admins"]))
+}
+
+func TestMergeRealmsError(t *testing.T) {
+	a := assert.New(t)
+
+	_, conflicts, err := MergeRealms(mergeTestConfig(MergeError), mergeTestGroups())
+	a.Error(err)
+	a.Contains(err.Error(), "admins (partner and prod)")
+	a.Len(conflicts, 1)
+}
+
+func TestMergeStrategyPrecedence(t *testing.T) {
+	a := assert.New(t)
+
+	config := mergeTestConfig(MergeError)
+	// the realm strategy is used instead of the global strategy
+	config.Realms[1].MergeStrategy = MergeFirstWins
+	a.Equal(MergeFirstWins, config.GetMergeStrategy(config.Realms[1], "admins"))
+	a.Equal(MergeError, config.GetMergeStrategy(config.Realms[0], "admins"))
+	// and the group strategy is used instead of both
+	config.GroupMergeStrategies = []GroupMergeConfig{{Group: "admins", Strategy: MergeUnion}}
+	a.Equal(MergeUnion, config.GetMergeStrategy(config.Realms[1], "admins"))
+	a.Equal(MergeFirstWins, config.GetMergeStrategy(config.Realms[1], "partners"))
+
+	merged, _, err := MergeRealms(config, mergeTestGroups())
+	a.Nil(err)
+	a.ElementsMatch([]string{"alice", "bob", "mallory"}, userNames(merged["admins"]))
+
+	// without any strategy the groups are combined
+	a.Equal(MergeUnion, Config{}.GetMergeStrategy(RealmConfig{}, "admins"))
+}
+
+func TestMergeStrategyConfig(t *testing.T) {
+	a := assert.New(t)
+
+	config := loadTestConfig("merge_strategies.yml", t)
+	a.Equal(MergeFirstWins, config.MergeStrategy)
+	a.Equal(MergePriority, config.Realms[0].MergeStrategy)
+	a.Equal(10, config.Realms[0].Priority)
+	a.Equal(MergeError, config.GetMergeStrategy(config.Realms[0], "platform.admins"))
+
+	_, err := loadTestConfigWithError("bad_merge_strategy.yml", t)
+	a.Error(err)
+}
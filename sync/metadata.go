@@ -0,0 +1,197 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+/**
+ * metadataTemplate is a label or annotation with its value parsed as a template
+ */
+type metadataTemplate struct {
+	key   string
+	value *template.Template
+}
+
+/**
+ * groupMetadataRule is the compiled form of the labels and annotations for the groups that match a path glob
+ */
+type groupMetadataRule struct {
+	pattern     *regexp.Regexp
+	labels      []metadataTemplate
+	annotations []metadataTemplate
+}
+
+/**
+ * groupMetadata renders the labels and annotations for the groups of a realm. the labels and annotations of the
+ *               realm are set first and then those of each group-metadata entry that matches in order so that a
+ *               later entry can replace a value.
+ */
+type groupMetadata struct {
+	realm RealmConfig
+	all   groupMetadataRule
+	rules []groupMetadataRule
+}
+
+func parseMetadata(realm RealmConfig, kind string, configs []MetadataConfig) ([]metadataTemplate, error) {
+	templates := make([]metadataTemplate, 0, len(configs))
+	for _, config := range configs {
+		if strings.HasPrefix(config.Key, constants.AnnotationPrefix) || config.Key == constants.LabelManagedBy {
+			return nil, fmt.Errorf("the %s %s for realm %s is managed by keycloak-sync and can't be set", kind, config.Key, realm.Name)
+		}
+		if problems := validation.IsQualifiedName(config.Key); len(problems) > 0 {
+			return nil, fmt.Errorf("invalid %s %s for realm %s: %s", kind, config.Key, realm.Name, strings.Join(problems, ", "))
+		}
+		value, err := template.New(config.Key).Option("missingkey=zero").Funcs(nameTemplateFunctions).Parse(config.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for the %s %s for realm %s: %s", kind, config.Key, realm.Name, err)
+		}
+		templates = append(templates, metadataTemplate{key: config.Key, value: value})
+	}
+	return templates, nil
+}
+
+/**
+ * newGroupMetadata parses the labels and annotations of the realm
+ */
+func newGroupMetadata(realm RealmConfig) (*groupMetadata, error) {
+	metadata := &groupMetadata{
+		realm: realm,
+		rules: make([]groupMetadataRule, 0, len(realm.GroupMetadata)),
+	}
+	var err error
+	if metadata.all.labels, err = parseMetadata(realm, "label", realm.Labels); err != nil {
+		return nil, err
+	}
+	if metadata.all.annotations, err = parseMetadata(realm, "annotation", realm.Annotations); err != nil {
+		return nil, err
+	}
+	for _, config := range realm.GroupMetadata {
+		rule := groupMetadataRule{}
+		if rule.pattern, err = globToRegexp(config.Path); err != nil {
+			return nil, fmt.Errorf("invalid group-metadata path %s for realm %s: %s", config.Path, realm.Name, err)
+		}
+		if rule.labels, err = parseMetadata(realm, "label", config.Labels); err != nil {
+			return nil, err
+		}
+		if rule.annotations, err = parseMetadata(realm, "annotation", config.Annotations); err != nil {
+			return nil, err
+		}
+		metadata.rules = append(metadata.rules, rule)
+	}
+	return metadata, nil
+}
+
+/**
+ * render executes each template with the values for the group and adds the results to the values
+ */
+func (metadata *groupMetadata) render(templates []metadataTemplate, data nameData, values map[string]string) error {
+	for _, metadataTemplate := range templates {
+		var builder strings.Builder
+		if err := metadataTemplate.value.Execute(&builder, data); err != nil {
+			return err
+		}
+		values[metadataTemplate.key] = builder.String()
+	}
+	return nil
+}
+
+/**
+ * apply renders the labels and annotations for the group and sets them as the labels and annotations that are
+ *       managed for the group. a label with a value that can't be used in OpenShift is left off of the group with
+ *       a warning so that the rest of the group (and realm) is still synchronized.
+ */
+func (metadata *groupMetadata) apply(group *Group, attributes *map[string][]string) error {
+	labels := make(map[string]string)
+	annotations := make(map[string]string)
+	data := newNameData(metadata.realm, group, attributes)
+	finalName := group.FinalName()
+
+	rules := append([]groupMetadataRule{metadata.all}, metadata.rules...)
+	for idx, rule := range rules {
+		if idx > 0 && !rule.pattern.MatchString(group.Path) && !rule.pattern.MatchString(finalName) {
+			continue
+		}
+		if err := metadata.render(rule.labels, data, labels); err != nil {
+			return fmt.Errorf("could not render the labels for group %s: %s", finalName, err)
+		}
+		if err := metadata.render(rule.annotations, data, annotations); err != nil {
+			return fmt.Errorf("could not render the annotations for group %s: %s", finalName, err)
+		}
+	}
+
+	for key, value := range labels {
+		if problems := validation.IsValidLabelValue(value); len(problems) > 0 {
+			logrus.Warnf("realm %s | the label %s for group %s has the value %q which can't be used, leaving it off (use labelValue in the template to make it usable): %s", metadata.realm.Name, key, finalName, value, strings.Join(problems, ", "))
+			delete(labels, key)
+		}
+	}
+
+	group.ManagedLabels = labels
+	group.ManagedAnnotations = annotations
+	return nil
+}
+
+/**
+ * mergeMetadata adds the labels and annotations that are not already in the target to it
+ */
+func mergeMetadata(target map[string]string, source map[string]string) map[string]string {
+	if len(source) < 1 {
+		return target
+	}
+	if target == nil {
+		target = make(map[string]string, len(source))
+	}
+	for key, value := range source {
+		if _, found := target[key]; !found {
+			target[key] = value
+		}
+	}
+	return target
+}
+
+/**
+ * metadataChanged returns true if the labels and annotations that keycloak-sync manages for the group, including
+ *                 where the group came from, are not all on the group in OpenShift yet
+ */
+func metadataChanged(group Group) bool {
+	if group.Labels[constants.LabelManagedBy] != constants.CreatedByKeycloakSync {
+		return true
+	}
+	provenance := provenanceAnnotations(group)
+	for _, key := range provenanceKeys {
+		if group.Annotations[key] != provenance[key] {
+			return true
+		}
+	}
+	for key, value := range group.ManagedLabels {
+		if current, found := group.Labels[key]; !found || current != value {
+			return true
+		}
+	}
+	for key, value := range group.ManagedAnnotations {
+		if current, found := group.Annotations[key]; !found || current != value {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * copyStringMap returns a copy of the map, nil stays nil
+ */
+func copyStringMap(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(values))
+	for key, value := range values {
+		copied[key] = value
+	}
+	return copied
+}
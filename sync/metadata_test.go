@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"context"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userapi "github.com/openshift/api/user/v1"
+	userfake "github.com/openshift/client-go/user/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func metadataTestRealm() RealmConfig {
+	return RealmConfig{
+		Name: "sso",
+		Labels: []MetadataConfig{
+			{Key: "team", Value: "shared"},
+			{Key: "keycloak.example.com/realm", Value: "{{.Realm}}"},
+		},
+		Annotations: []MetadataConfig{
+			{Key: "example.com/source", Value: "{{.Realm}}:{{.ID}}:{{.Path}}"},
+		},
+		GroupMetadata: []GroupMetadataConfig{
+			{
+				Path:   "/platform/**",
+				Labels: []MetadataConfig{{Key: "team", Value: "platform"}},
+			},
+			{
+				Path:        "/platform/ops",
+				Annotations: []MetadataConfig{{Key: "example.com/pager", Value: "{{.Attribute \"pager\" | lower}}"}},
+			},
+		},
+	}
+}
+
+func TestGroupMetadata(t *testing.T) {
+	a := assert.New(t)
+
+	metadata, err := newGroupMetadata(metadataTestRealm())
+	a.Nil(err)
+
+	group := Group{Id: "id-ops", Name: "ops", Path: "/platform/ops"}
+	attributes := map[string][]string{"pager": {"OPS-ONCALL"}}
+	a.Nil(metadata.apply(&group, &attributes))
+	a.Equal(map[string]string{"team": "platform", "keycloak.example.com/realm": "sso"}, group.ManagedLabels)
+	a.Equal(map[string]string{"example.com/source": "sso:id-ops:/platform/ops", "example.com/pager": "ops-oncall"}, group.ManagedAnnotations)
+
+	// only the labels and annotations of the realm
+	group = Group{Id: "id-dev", Name: "developers", Path: "/developers"}
+	a.Nil(metadata.apply(&group, nil))
+	a.Equal("shared", group.ManagedLabels["team"])
+	a.Equal(map[string]string{"example.com/source": "sso:id-dev:/developers"}, group.ManagedAnnotations)
+
+	// the output group has the labels and annotations along with the ones keycloak-sync manages
+	group.Source = "realm:sso"
+	group.Realms = []string{"sso"}
+	openshiftGroup, _ := group.ToOpenShiftGroup(Config{})
+	a.Equal(constants.CreatedByKeycloakSync, openshiftGroup.Labels[constants.LabelManagedBy])
+	a.Equal("shared", openshiftGroup.Labels["team"])
+	a.Equal("sso:id-dev:/developers", openshiftGroup.Annotations["example.com/source"])
+	a.Equal("sso", openshiftGroup.Annotations[constants.AnnotationRealms])
+}
+
+func TestGetGroupsAndUsersForRealmMetadataAttributes(t *testing.T) {
+	a := assert.New(t)
+
+	// the fake leaves the attributes out of listed groups unless the full representation is asked for
+	fake := newFakeKeycloak(t)
+	ops := attributedGroup("ops", "/platform", map[string][]string{"pager": {"OPS-ONCALL"}, "cost-center": {"42"}})
+	platform := attributedGroup("platform", "", map[string][]string{"cost-center": {"7"}}, ops)
+	fake.groups = append(fake.groups, &platform)
+
+	realm := fake.realmConfig()
+	realm.Subgroups = true
+	realm.SubgroupConcat = true
+	realm.Labels = []MetadataConfig{{Key: "cost-center", Value: "{{.Attribute \"cost-center\"}}"}}
+	a.True(realm.needsGroupAttributes())
+
+	session := newKeycloakSession(realm)
+	defer session.close()
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+	a.Equal("7", groups["platform"].ManagedLabels["cost-center"])
+	a.Equal("42", groups["platform.ops"].ManagedLabels["cost-center"])
+
+	// the same for the annotations of a group-metadata entry
+	realm.Labels = nil
+	realm.GroupMetadata = []GroupMetadataConfig{{Path: "/platform/ops", Annotations: []MetadataConfig{{Key: "example.com/pager", Value: "{{index .Attributes.pager 0}}"}}}}
+	a.True(realm.needsGroupAttributes())
+	session = newKeycloakSession(realm)
+	defer session.close()
+	groups, err = getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+	a.Equal("OPS-ONCALL", groups["platform.ops"].ManagedAnnotations["example.com/pager"])
+
+	// templates that do not use the attributes keep the brief representation
+	realm.GroupMetadata = []GroupMetadataConfig{{Path: "/platform/**", Labels: []MetadataConfig{{Key: "team", Value: "{{.Name}}"}}}}
+	a.False(realm.needsGroupAttributes())
+}
+
+func TestGroupMetadataErrors(t *testing.T) {
+	a := assert.New(t)
+
+	// the keys keycloak-sync uses can't be set
+	realm := RealmConfig{Name: "sso", Annotations: []MetadataConfig{{Key: constants.AnnotationRealms, Value: "other"}}}
+	_, err := newGroupMetadata(realm)
+	a.Error(err)
+	a.Contains(err.Error(), "managed by keycloak-sync")
+	realm = RealmConfig{Name: "sso", Labels: []MetadataConfig{{Key: constants.LabelManagedBy, Value: "other"}}}
+	_, err = newGroupMetadata(realm)
+	a.Error(err)
+
+	// keys must be valid
+	realm = RealmConfig{Name: "sso", Labels: []MetadataConfig{{Key: "not a key", Value: "value"}}}
+	_, err = newGroupMetadata(realm)
+	a.Error(err)
+
+}
+
+func TestGroupMetadataLabelValues(t *testing.T) {
+	a := assert.New(t)
+
+	// a path is not a valid label value so the label is left off but the other labels are kept
+	realm := RealmConfig{Name: "sso", Labels: []MetadataConfig{
+		{Key: "path", Value: "{{.Path}}"},
+		{Key: "team", Value: "ops"},
+		{Key: "safe-path", Value: "{{.Path | labelValue}}"},
+	}}
+	metadata, err := newGroupMetadata(realm)
+	a.Nil(err)
+	group := Group{Name: "ops", Path: "/platform/ops"}
+	a.Nil(metadata.apply(&group, nil))
+	a.Equal(map[string]string{"team": "ops", "safe-path": "platform-ops"}, group.ManagedLabels)
+
+	a.Equal("platform-ops", labelValue("/platform/ops/"))
+	a.Equal("a.b_c", labelValue("_a.b_c."))
+	a.Equal(strings.Repeat("a", 63), labelValue("/"+strings.Repeat("a", 70)))
+	// the value does not end with the separator after it is shortened
+	a.Equal(strings.Repeat("a", 62), labelValue("/"+strings.Repeat("a", 62)+"/b"))
+}
+
+func TestMergeMetadata(t *testing.T) {
+	a := assert.New(t)
+
+	keycloakGroups := GroupList{"developers": Group{
+		Name:               "developers",
+		Source:             "realm:sso",
+		Realms:             []string{"sso"},
+		Users:              map[string]User{"alice": {Name: "alice"}},
+		ManagedLabels:      map[string]string{"team": "platform"},
+		ManagedAnnotations: map[string]string{"example.com/owner": "platform"},
+	}}
+	labelled := func(labels map[string]string) GroupList {
+		group := userapi.Group{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "developers",
+				Labels:      labels,
+				Annotations: map[string]string{constants.AnnotationCreatedBy: constants.CreatedByKeycloakSync, "example.com/owner": "platform"},
+			},
+			Users: userapi.OptionalNames{"alice"},
+		}
+		return GroupList{"developers": FromOpenShiftGroup(Config{}, group)}
+	}
+
+	// a group that does not have the labels yet is changed
+	merged := Merge(labelled(nil), keycloakGroups)
+	a.True(merged["developers"].Changed)
+	a.Len(merged.ToOpenShiftGroups(Config{}, true).Items, 1)
+
+	// a group that already has them is not
+	merged = Merge(labelled(map[string]string{constants.LabelManagedBy: constants.CreatedByKeycloakSync, "team": "platform"}), keycloakGroups)
+	a.False(merged["developers"].Changed)
+	a.Len(merged.ToOpenShiftGroups(Config{}, true).Items, 0)
+
+	// a label with a different value changes the group
+	merged = Merge(labelled(map[string]string{constants.LabelManagedBy: constants.CreatedByKeycloakSync, "team": "other"}), keycloakGroups)
+	a.True(merged["developers"].Changed)
+}
+
+func TestApplyKeepsLabels(t *testing.T) {
+	a := assert.New(t)
+
+	existing := userapi.Group{
+		ObjectMeta: v1.ObjectMeta{Name: "developers", Labels: map[string]string{"other": "kept"}},
+		Users:      userapi.OptionalNames{"alice"},
+	}
+	client := userfake.NewSimpleClientset(&existing)
+
+	group := Group{Name: "developers", Source: "realm:sso", Realms: []string{"sso"}, Users: map[string]User{"alice": {Name: "alice"}}, ManagedLabels: map[string]string{"team": "platform"}}
+	desired, _ := group.ToOpenShiftGroup(Config{})
+	_, err := ApplyOpenShiftGroups(context.Background(), client, userapi.GroupList{Items: []userapi.Group{existing}}, userapi.GroupList{Items: []userapi.Group{desired}}, nil)
+	a.Nil(err)
+
+	updated, err := client.UserV1().Groups().Get(context.Background(), "developers", v1.GetOptions{})
+	a.Nil(err)
+	a.Equal(map[string]string{"other": "kept", "team": "platform", constants.LabelManagedBy: constants.CreatedByKeycloakSync}, updated.Labels)
+}
+
+func TestMetadataConfig(t *testing.T) {
+	a := assert.New(t)
+
+	config := loadTestConfig("group_metadata.yml", t)
+	realm := config.Realms[0]
+	a.Equal([]MetadataConfig{{Key: "app.kubernetes.io/part-of", Value: "platform"}}, realm.Labels)
+	a.Equal("example.com/keycloak-path", realm.Annotations[0].Key)
+	a.Equal("{{.Path}}", realm.Annotations[0].Value)
+	a.Equal("/platform/**", realm.GroupMetadata[0].Path)
+	a.Equal("team", realm.GroupMetadata[0].Labels[0].Key)
+}
@@ -0,0 +1,151 @@
+package sync
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+/**
+ * DefaultNameTemplate produces the same names as the alias, group-prefix, group-suffix, subgroup-concat-names,
+ *                     and subgroup-separator options. it is used when a realm does not have a name template.
+ */
+const DefaultNameTemplate = `{{if .Alias}}{{.Alias}}{{else}}{{.Prefix}}{{if .Concat}}{{range .Parents}}{{.}}{{$.Separator}}{{end}}{{end}}{{.Name}}{{.Suffix}}{{end}}`
+
+/**
+ * nameData is the value given to a name template
+ */
+type nameData struct {
+	// the name of the realm
+	Realm string
+	// the id and name of the group (or role) in keycloak
+	ID   string
+	Name string
+	// the keycloak path of the group and the names in the path, empty for roles
+	Path     string
+	Segments []string
+	// the names of the parent groups that were not skipped with the root first
+	Parents []string
+	// the keycloak attributes of the group (or role)
+	Attributes map[string][]string
+
+	// the values of the naming options for the group
+	Alias     string
+	Prefix    string
+	Suffix    string
+	Concat    bool
+	Separator string
+}
+
+/**
+ * Attribute returns the first value of the keycloak attribute or an empty string if it is not set
+ */
+func (data nameData) Attribute(name string) string {
+	if values := data.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// characters that are replaced by sanitize
+var unsafeNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var nameTemplateFunctions = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"join":  func(separator string, values []string) string { return strings.Join(values, separator) },
+	// the string is the last argument so that the functions can be used in a pipeline
+	"replace": func(old string, new string, value string) string { return strings.ReplaceAll(value, old, new) },
+	"truncate": func(length int, value string) string {
+		if length < 0 || len(value) <= length {
+			return value
+		}
+		return value[:length]
+	},
+	// replaces each run of characters that are not letters, numbers, ".", "_", or "-" with a "-"
+	"sanitize": func(value string) string {
+		return strings.Trim(unsafeNameCharacters.ReplaceAllString(value, "-"), "-")
+	},
+	// makes the value usable as a label value like "/platform/ops" to "platform-ops": sanitized, at most 63
+	// characters, and starting and ending with a letter or number
+	"labelValue": labelValue,
+}
+
+// the characters that a label value can't start or end with
+const labelValueEdges = "._-"
+
+func labelValue(value string) string {
+	value = strings.Trim(unsafeNameCharacters.ReplaceAllString(value, "-"), labelValueEdges)
+	if len(value) > validation.LabelValueMaxLength {
+		value = strings.TrimRight(value[:validation.LabelValueMaxLength], labelValueEdges)
+	}
+	return value
+}
+
+/**
+ * newNameTemplate parses the name template for the realm or the default template if the realm does not have one
+ */
+func newNameTemplate(realm RealmConfig) (*template.Template, error) {
+	text := realm.NameTemplate
+	if len(strings.TrimSpace(text)) < 1 {
+		text = DefaultNameTemplate
+	}
+	nameTemplate, err := template.New(realm.Name).Option("missingkey=zero").Funcs(nameTemplateFunctions).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template for realm %s: %s", realm.Name, err)
+	}
+	return nameTemplate, nil
+}
+
+/**
+ * newNameData returns the values given to the templates for the group
+ */
+func newNameData(realm RealmConfig, group *Group, attributes *map[string][]string) nameData {
+	data := nameData{
+		Realm:      realm.Name,
+		ID:         group.Id,
+		Name:       group.Name,
+		Path:       group.Path,
+		Segments:   make([]string, 0),
+		Parents:    make([]string, 0),
+		Attributes: make(map[string][]string),
+		Alias:      group.Alias,
+		Prefix:     group.Prefix,
+		Suffix:     group.Suffix,
+		Concat:     group.SubgroupConcat,
+		Separator:  realm.GetSubgroupSeparator(),
+	}
+	for _, segment := range strings.Split(group.Path, "/") {
+		if len(segment) > 0 {
+			data.Segments = append(data.Segments, segment)
+		}
+	}
+	for parent := group.Parent; parent != nil; parent = parent.Parent {
+		if !parent.Skipped {
+			data.Parents = append([]string{parent.Name}, data.Parents...)
+		}
+	}
+	if attributes != nil {
+		data.Attributes = *attributes
+	}
+	return data
+}
+
+/**
+ * renderName executes the name template for the group and sets the result as the name of the group
+ */
+func renderName(nameTemplate *template.Template, realm RealmConfig, group *Group, attributes *map[string][]string) error {
+	var builder strings.Builder
+	if err := nameTemplate.Execute(&builder, newNameData(realm, group, attributes)); err != nil {
+		return fmt.Errorf("could not name group %s: %s", group.Name, err)
+	}
+	name := builder.String()
+	if len(strings.TrimSpace(name)) < 1 {
+		return fmt.Errorf("the name template for realm %s gave an empty name for %s", realm.Name, group.Name)
+	}
+	group.TemplatedName = name
+	return nil
+}
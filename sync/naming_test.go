@@ -0,0 +1,70 @@
+package sync
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDefaultNameTemplateMatchesOptions(t *testing.T) {
+	a := assert.New(t)
+
+	root := Group{Name: "admins", Path: "/admins"}
+	skipped := Group{Name: "skipped", Path: "/admins/skipped", Parent: &root, Skipped: true}
+	child := Group{Name: "db", Path: "/admins/db", Parent: &root}
+
+	groups := []Group{
+		{Name: "developers", Path: "/developers"},
+		{Name: "developers", Path: "/developers", Prefix: "sso-", Suffix: "-dev"},
+		{Name: "developers", Path: "/developers", Prefix: "sso-", Alias: "devs"},
+		{Name: "db", Path: "/admins/db", Parent: &root, Prefix: "sso-", SubgroupConcat: true},
+		{Name: "db", Path: "/admins/db", Parent: &root, SubgroupConcat: false},
+		{Name: "db", Path: "/admins/db", Parent: &root, SubgroupConcat: true, SubgroupSeparator: "_"},
+		{Name: "db", Path: "/admins/db", Parent: &root, SubgroupConcat: true, SubgroupSeparator: " "},
+		{Name: "pg", Path: "/admins/skipped/pg", Parent: &skipped, SubgroupConcat: true},
+		{Name: "pg", Path: "/admins/db/pg", Parent: &child, SubgroupConcat: true, Suffix: "-x"},
+		{Name: "pg", Path: "/admins/db/pg", Parent: &child, SubgroupConcat: true, Alias: "postgres"},
+	}
+
+	for _, group := range groups {
+		realm := RealmConfig{Name: "sso", SubgroupSeparator: group.SubgroupSeparator}
+		nameTemplate, err := newNameTemplate(realm)
+		a.Nil(err)
+
+		expected := group.FinalName()
+		a.Nil(renderName(nameTemplate, realm, &group, nil))
+		a.Equal(expected, group.TemplatedName)
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	a := assert.New(t)
+
+	root := Group{Name: "Platform", Path: "/Platform"}
+	group := Group{Name: "DB_Admins", Path: "/Platform/DB_Admins", Parent: &root}
+	attributes := map[string][]string{"team": {"Storage Team"}}
+
+	realm := RealmConfig{
+		Name:         "sso",
+		NameTemplate: `{{.Realm}}-{{join "-" .Segments | replace "_" "-" | lower | truncate 15}}-{{.Attribute "team" | sanitize | lower}}{{.Attribute "missing"}}`,
+	}
+	nameTemplate, err := newNameTemplate(realm)
+	a.Nil(err)
+	a.Nil(renderName(nameTemplate, realm, &group, &attributes))
+	a.Equal("sso-platform-db-adm-storage-team", group.FinalName())
+
+	// the parents are available to the template
+	realm.NameTemplate = `{{range .Parents}}{{. | lower}}/{{end}}{{.Name}}`
+	nameTemplate, err = newNameTemplate(realm)
+	a.Nil(err)
+	a.Nil(renderName(nameTemplate, realm, &group, nil))
+	a.Equal("platform/DB_Admins", group.FinalName())
+
+	// templates that don't parse or that give an empty name are errors
+	realm.NameTemplate = `{{.Name`
+	_, err = newNameTemplate(realm)
+	a.Error(err)
+	realm.NameTemplate = `{{.Alias}}`
+	nameTemplate, err = newNameTemplate(realm)
+	a.Nil(err)
+	a.Error(renderName(nameTemplate, realm, &group, nil))
+}
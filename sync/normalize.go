@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/validation/path"
+	"regexp"
+	"strings"
+)
+
+// the characters that are replaced when no pattern is configured
+const defaultIllegalCharacters = `[^A-Za-z0-9._-]`
+
+// the number of characters of the hash that is added to names that are too long
+const nameHashLength = 8
+
+/**
+ * nameNormalizer applies the name rules for a realm to the final name of each group
+ */
+type nameNormalizer struct {
+	config  NameRulesConfig
+	illegal *regexp.Regexp
+}
+
+func newNameNormalizer(config NameRulesConfig) (*nameNormalizer, error) {
+	pattern := config.IllegalCharacters
+	if len(pattern) < 1 {
+		pattern = defaultIllegalCharacters
+	}
+	illegal, err := regexp.Compile("(?:" + pattern + ")+")
+	if err != nil {
+		return nil, fmt.Errorf("invalid illegal-characters pattern %s: %s", pattern, err)
+	}
+	return &nameNormalizer{
+		config:  config,
+		illegal: illegal,
+	}, nil
+}
+
+/**
+ * normalize lowercases the name, replaces each run of illegal characters, and shortens the name so that it is
+ *           not longer than the maximum length by replacing the end of the name with a hash of the whole name.
+ *           each step is only done if it is configured.
+ */
+func (normalizer *nameNormalizer) normalize(name string) string {
+	if normalizer.config.Lowercase {
+		name = strings.ToLower(name)
+	}
+
+	if replacement := normalizer.config.Replacement; len(replacement) > 0 {
+		name = normalizer.illegal.ReplaceAllString(name, replacement)
+		name = strings.TrimSuffix(strings.TrimPrefix(name, replacement), replacement)
+	}
+
+	if maxLength := normalizer.config.MaxLength; maxLength > 0 && len([]rune(name)) > maxLength {
+		hash := sha256.Sum256([]byte(name))
+		suffix := "-" + hex.EncodeToString(hash[:])[:nameHashLength]
+		runes := []rune(name)
+		name = string(runes[:maxLength-len(suffix)]) + suffix
+	}
+
+	return name
+}
+
+/**
+ * validateGroupName returns the reasons that a name can't be used for an OpenShift group, if any
+ */
+func validateGroupName(name string) []string {
+	if len(name) < 1 {
+		return []string{"may not be empty"}
+	}
+	return path.IsValidPathSegmentName(name)
+}
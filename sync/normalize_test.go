@@ -0,0 +1,127 @@
+package sync
+
+import (
+	"context"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	a := assert.New(t)
+
+	// without any rules the name is unchanged
+	normalizer, err := newNameNormalizer(NameRulesConfig{})
+	a.Nil(err)
+	a.Equal("Team A/Admins", normalizer.normalize("Team A/Admins"))
+
+	normalizer, err = newNameNormalizer(NameRulesConfig{Lowercase: true, Replacement: "-"})
+	a.Nil(err)
+	a.Equal("team-a-admins", normalizer.normalize("Team A/Admins"))
+	a.Equal("r-d", normalizer.normalize(" (R&D) "))
+	a.Equal("already.valid_name", normalizer.normalize("already.valid_name"))
+
+	// a custom pattern replaces only what it matches
+	normalizer, err = newNameNormalizer(NameRulesConfig{Replacement: "_", IllegalCharacters: "[ /]"})
+	a.Nil(err)
+	a.Equal("Team_A_Admins", normalizer.normalize("Team A / Admins"))
+
+	_, err = newNameNormalizer(NameRulesConfig{Replacement: "_", IllegalCharacters: "["})
+	a.Error(err)
+}
+
+func TestNormalizeNameMaxLength(t *testing.T) {
+	a := assert.New(t)
+
+	normalizer, err := newNameNormalizer(NameRulesConfig{MaxLength: 20})
+	a.Nil(err)
+
+	a.Equal("short-enough", normalizer.normalize("short-enough"))
+
+	first := normalizer.normalize("platform-engineering-database-admins")
+	second := normalizer.normalize("platform-engineering-database-readers")
+	a.Len(first, 20)
+	a.Len(second, 20)
+	a.True(strings.HasPrefix(first, "platform-en-"))
+	a.NotEqual(first, second)
+	// the same name always gets the same hash
+	a.Equal(first, normalizer.normalize("platform-engineering-database-admins"))
+}
+
+func TestValidateGroupName(t *testing.T) {
+	a := assert.New(t)
+
+	a.Empty(validateGroupName("developers"))
+	a.Empty(validateGroupName("Team A"))
+	a.NotEmpty(validateGroupName(""))
+	a.NotEmpty(validateGroupName("."))
+	a.NotEmpty(validateGroupName(".."))
+	a.NotEmpty(validateGroupName("teams/admins"))
+	a.NotEmpty(validateGroupName("100%"))
+}
+
+func TestGetGroupsAndUsersForRealmNameRules(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	spaced := fakeGroup("Team A", "")
+	ampersand := fakeGroup("R&D", "")
+	fake.groups = append(fake.groups, &spaced, &ampersand)
+
+	realm := fake.realmConfig()
+	realm.NameRules = NameRulesConfig{Lowercase: true, Replacement: "-"}
+
+	session := newKeycloakSession(realm)
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	session.close()
+	a.Nil(err)
+	names := make([]string, 0)
+	for name := range groups {
+		names = append(names, name)
+	}
+	a.ElementsMatch([]string{"team-a", "r-d"}, names)
+
+	// two groups that normalize to the same name are reported together and no members are requested
+	requested := fake.count("members")
+	collision := fakeGroup("team_a", "")
+	fake.groups = append(fake.groups, &collision)
+	realm.NameRules.IllegalCharacters = "[^a-z0-9.-]"
+	session = newKeycloakSession(realm)
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	session.close()
+	a.Error(err)
+	a.Contains(err.Error(), `group /Team A and group /team_a are both named "team-a"`)
+	a.Equal(requested, fake.count("members"))
+
+	// names that are not valid without any rules are reported
+	slashed := fakeGroup("a/b", "")
+	fake.groups = []*gocloak.Group{&slashed}
+	session = newKeycloakSession(fake.realmConfig())
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	session.close()
+	a.Error(err)
+	a.Contains(err.Error(), `group /a/b has the name "a/b"`)
+
+	// subgroups with the same name are different groups when their names are not concatenated
+	first := fakeGroup("a", "", fakeGroup("stage", "/a"))
+	second := fakeGroup("b", "", fakeGroup("stage", "/b"))
+	fake.groups = []*gocloak.Group{&first, &second}
+	realm = fake.realmConfig()
+	realm.Subgroups = true
+	session = newKeycloakSession(realm)
+	_, err = getGroupsAndUsersForRealm(context.Background(), session)
+	session.close()
+	a.Error(err)
+	a.Contains(err.Error(), `group /a/stage and group /b/stage are both named "stage"`)
+
+	// the same group found twice by name is not a collision
+	realm = fake.realmConfig()
+	realm.Groups = []string{"a", "a"}
+	session = newKeycloakSession(realm)
+	groups, err = getGroupsAndUsersForRealm(context.Background(), session)
+	session.close()
+	a.Nil(err)
+	a.Len(groups, 1)
+	a.Contains(groups, "a")
+}
@@ -2,8 +2,10 @@ package sync
 
 import (
 	"bytes"
+	"fmt"
 	userapi "github.com/openshift/api/user/v1"
 	"io"
+	serializer "k8s.io/apimachinery/pkg/runtime/serializer/json"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
@@ -43,10 +45,13 @@ func GetOpenShiftGroupsFromReader(config Config, reader io.Reader) (GroupList, e
 
 	for _, item := range ocGroups.Items {
 		syncGroup := Group{
-			Id:     "openshift",
-			Source: "openshift",
-			Name:   item.Name,
-			Users:  make(map[string]User),
+			Id:          "openshift",
+			Source:      "openshift",
+			Name:        item.Name,
+			Users:       make(map[string]User),
+			Labels:      item.GetLabels(),
+			Annotations: item.GetAnnotations(),
+			LiveUsers:   sortedUsers(item.Users),
 		}
 		// this is the same as "Name" but maintains consistency
 		output[syncGroup.FinalName()] = syncGroup
@@ -55,12 +60,15 @@ func GetOpenShiftGroupsFromReader(config Config, reader io.Reader) (GroupList, e
 		if item.Users == nil || len(item.Users) < 0 {
 			continue
 		}
+		// users can only be pruned from groups that keycloak-sync owns
+		prune := config.Prune && syncGroup.IsOwned()
+
 		// add users to group if there are users
 		for _, user := range item.Users {
 			syncUser := User{
 				Id:    "openshift",
 				Name:  user,
-				Prune: config.Prune, // uses the config setting so these can be trimmed later
+				Prune: prune, // uses the config setting so these can be trimmed later
 			}
 			syncGroup.Users[syncUser.Name] = syncUser
 		}
@@ -68,3 +76,22 @@ func GetOpenShiftGroupsFromReader(config Config, reader io.Reader) (GroupList, e
 
 	return output, nil
 }
+
+/**
+ * WriteOpenShiftGroups encodes the group list to the writer as yaml, or as json when the format is "json". the
+ *                      groups, users, and the keys of the labels and annotations are written in sorted order so
+ *                      the same groups are always written the same way.
+ */
+func WriteOpenShiftGroups(groups userapi.GroupList, format string, writer io.Writer) error {
+	ser := serializer.NewSerializerWithOptions(serializer.DefaultMetaFactory, nil, nil, serializer.SerializerOptions{
+		Yaml:   "json" != format,
+		Pretty: true,
+		Strict: true,
+	})
+	err := ser.Encode(&groups, writer)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(writer, "\n")
+	return err
+}
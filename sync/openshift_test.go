@@ -1,14 +1,23 @@
 package sync
 
 import (
+	"bytes"
+	"flag"
+	"github.com/chrisruffalo/keycloak-sync/constants"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
+// run "go test ./sync -run Golden -update" to write the golden files again after an intended change to the output
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
 func loadTestGroupFile(testFileName string, t *testing.T) io.Reader {
 	// load configuration
 	_, filename, _, _ := runtime.Caller(0)
@@ -65,3 +74,176 @@ func TestOpenShiftSingleGroupJSON(t *testing.T) {
 	syncGroups, err := GetOpenShiftGroupsFromReader(Config{}, loadTestGroupFile("input-group-single.json", t))
 	testOpenShiftSingleGroup(syncGroups, err, t)
 }
+
+/**
+ * goldenGroups returns groups from two realms with more than one user, source, label, and annotation so that
+ *              every part of the output that comes from a map or a merge is in the golden files
+ */
+func goldenGroups() GroupList {
+	syncedAt := time.Date(2020, 8, 13, 3, 6, 54, 0, time.UTC)
+	users := func(names ...string) map[string]User {
+		userMap := make(map[string]User)
+		for _, name := range names {
+			userMap[name] = User{Id: "id-" + name, Name: name}
+		}
+		return userMap
+	}
+
+	opsUsers := users("zoe", "alice", "mike")
+	opsUsers["bob"] = User{Id: "id-bob", Name: "bob", Via: "/ops/oncall"}
+	opsUsers["carol"] = User{Id: "id-carol", Name: "carol", Via: "/ops/db"}
+
+	return GroupList{
+		"sso-ops": {
+			Name:     "ops",
+			Prefix:   "sso-",
+			Path:     "/ops",
+			Users:    opsUsers,
+			Source:   "realm:sso",
+			Realms:   []string{"sso", "corp", "sso"},
+			SyncedAt: syncedAt,
+			Sources: []GroupSource{
+				{Realm: "sso", URL: "https://sso.example.com/auth/realms/sso", ID: "id-ops", Path: "/ops"},
+				{Realm: "corp", URL: "https://sso.example.com/auth/realms/corp", ID: "id-operators", Role: "operators"},
+				{Realm: "corp", URL: "https://sso.example.com/auth/realms/corp", ID: "id-corp-ops", Path: "/ops"},
+			},
+			ManagedLabels:      map[string]string{"team": "ops", "app.kubernetes.io/part-of": "platform", "env": "prod"},
+			ManagedAnnotations: map[string]string{"example.com/pager": "ops-oncall", "example.com/owner": "ops", "a.example.com/cost-center": "42"},
+		},
+		"sso-developers": {
+			Name:     "developers",
+			Prefix:   "sso-",
+			Path:     "/developers",
+			Users:    users("yusuf", "dana", "erin", "frank", "bob"),
+			Source:   "realm:sso",
+			Realms:   []string{"sso"},
+			SyncedAt: syncedAt,
+			Sources: []GroupSource{
+				{Realm: "sso", URL: "https://sso.example.com/auth/realms/sso", ID: "id-developers", Path: "/developers"},
+			},
+			ManagedLabels: map[string]string{"team": "dev"},
+		},
+		"admins": {
+			Name:     "admins",
+			Path:     "/admins",
+			Users:    users("root", "alice"),
+			Source:   "realm:corp",
+			Realms:   []string{"corp"},
+			SyncedAt: syncedAt,
+			Sources: []GroupSource{
+				{Realm: "corp", URL: "https://sso.example.com/auth/realms/corp", ID: "id-admins", Path: "/admins"},
+			},
+		},
+	}
+}
+
+func checkGolden(golden string, actual []byte, t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	goldenFile := filepath.Join(filepath.Dir(filename), "testdata", golden)
+	if *updateGolden {
+		if err := ioutil.WriteFile(goldenFile, actual, 0644); err != nil {
+			t.Fatalf("could not write golden file: %s", err)
+		}
+	}
+	expected, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("could not read golden file: %s", err)
+	}
+	assert.Equal(t, string(expected), string(actual), "output does not match %s", golden)
+}
+
+func TestOpenShiftGroupOutputGolden(t *testing.T) {
+	for _, format := range []string{"yaml", "json"} {
+		golden := "output-groups.yml"
+		if format == "json" {
+			golden = "output-groups.json"
+		}
+
+		// the groups are converted many times so that a different map order would show up as a different output
+		var first []byte
+		for idx := 0; idx < 20; idx++ {
+			groups := goldenGroups()
+			var buf bytes.Buffer
+			if err := WriteOpenShiftGroups(groups.ToOpenShiftGroups(Config{}, false), format, &buf); err != nil {
+				t.Fatalf("could not write groups: %s", err)
+			}
+			if first == nil {
+				first = buf.Bytes()
+				checkGolden(golden, first, t)
+				continue
+			}
+			if !bytes.Equal(first, buf.Bytes()) {
+				t.Fatalf("%s output changed between runs", format)
+			}
+		}
+	}
+}
+
+func TestOpenShiftGroupOutputSameEachRun(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	ops := fakeGroup("ops", "/platform")
+	db := fakeGroup("db", "/platform")
+	platform := fakeGroup("platform", "", ops, db)
+	developers := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &platform, &developers)
+	fake.members[*platform.ID] = fakeUsers("lead", 3)
+	fake.members[*ops.ID] = fakeUsers("ops", 4)
+	fake.members[*db.ID] = fakeUsers("db", 4)
+	fake.members[*developers.ID] = fakeUsers("dev", 6)
+
+	realm := fake.realmConfig()
+	realm.Subgroups = true
+	realm.SubgroupConcat = true
+	realm.SubgroupUsers = true
+	realm.Workers = 4
+	realm.Annotations = []MetadataConfig{{Key: "example.com/path", Value: "{{.Path}}"}}
+	config := Config{Realms: []RealmConfig{realm}}
+
+	// the groups are read from keycloak and written out the same way as the command, a second apart so that
+	// anything that records the time of the sync would be different
+	run := func(syncedAt bool) []byte {
+		groups, err := GetKeycloakGroups(config)
+		a.Nil(err)
+		final := Merge(GroupList{}, groups)
+		output := final.ToOpenShiftGroups(config, true)
+		if syncedAt {
+			output = final.WithSyncedAt(output)
+		}
+		var buf bytes.Buffer
+		a.Nil(WriteOpenShiftGroups(output, "yaml", &buf))
+		return buf.Bytes()
+	}
+	first := run(false)
+	time.Sleep(1100 * time.Millisecond)
+	second := run(false)
+	a.Equal(string(first), string(second))
+	a.NotContains(string(first), constants.AnnotationSyncedAt)
+	a.Contains(string(first), "name: platform.ops")
+
+	// with the "synced-at" option every group has the time of the sync and the output changes
+	third := run(true)
+	a.Equal(strings.Count(string(third), "name: "), strings.Count(string(third), constants.AnnotationSyncedAt+":"))
+	a.NotEqual(string(first), string(third))
+}
+
+func TestOpenShiftGroupDeletionsSorted(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{PruneGroups: true, Realms: []RealmConfig{{Name: "sso"}}}
+	groups := GroupList{}
+	for _, name := range []string{"zeta", "alpha", "mu", "beta", "omega"} {
+		groups[name] = Group{
+			Name:        name,
+			Source:      "openshift",
+			Annotations: map[string]string{constants.AnnotationCreatedBy: constants.CreatedByKeycloakSync, constants.AnnotationRealms: "sso"},
+		}
+	}
+
+	names := make([]string, 0)
+	for _, group := range groups.ToOpenShiftGroupDeletions(config).Items {
+		names = append(names, group.Name)
+	}
+	a.Equal([]string{"alpha", "beta", "mu", "omega", "zeta"}, names)
+}
@@ -0,0 +1,91 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/**
+ * RealmFailure is an optional realm that could not be read and the reason why
+ */
+type RealmFailure struct {
+	Realm string
+	Err   error
+}
+
+/**
+ * PartialSyncError is returned along with the groups from the realms that could be read when the only realms
+ *                  that failed are optional. the groups from the failed realms must be kept as they are with
+ *                  KeepFailedRealmGroups before they are merged.
+ */
+type PartialSyncError struct {
+	Failures []RealmFailure
+}
+
+func (err *PartialSyncError) Error() string {
+	failures := make([]string, 0, len(err.Failures))
+	for _, failure := range err.Failures {
+		failures = append(failures, fmt.Sprintf("%s (%s)", failure.Realm, failure.Err))
+	}
+	return fmt.Sprintf("%d optional realm(s) could not be read: %s", len(err.Failures), strings.Join(failures, ", "))
+}
+
+/**
+ * FailedRealms returns the names of the realms that could not be read
+ */
+func (err *PartialSyncError) FailedRealms() []string {
+	realms := make([]string, 0, len(err.Failures))
+	for _, failure := range err.Failures {
+		realms = append(realms, failure.Realm)
+	}
+	return realms
+}
+
+/**
+ * AsPartialSync returns the partial sync error and true when the error is (or wraps) a PartialSyncError
+ */
+func AsPartialSync(err error) (*PartialSyncError, bool) {
+	var partial *PartialSyncError
+	if err != nil && errors.As(err, &partial) {
+		return partial, true
+	}
+	return nil, false
+}
+
+/**
+ * KeepFailedRealmGroups returns a copy of the OpenShift groups where every group that keycloak-sync created from
+ *                       any of the failed realms is kept as it is: none of its users are pruned and it is not
+ *                       deleted. users from the realms that could be read are still added to the group.
+ */
+func KeepFailedRealmGroups(openshiftGroups GroupList, failedRealms []string) GroupList {
+	output := openshiftGroups.copy()
+	if len(failedRealms) < 1 {
+		return output
+	}
+
+	failed := make(map[string]bool, len(failedRealms))
+	for _, realm := range failedRealms {
+		failed[realm] = true
+	}
+
+	for name, group := range output {
+		if !group.IsOwned() {
+			continue
+		}
+		for _, realm := range group.OwnedRealms() {
+			if !failed[realm] {
+				continue
+			}
+			for userName, user := range group.Users {
+				user.Prune = false
+				group.Users[userName] = user
+			}
+			group.Kept = true
+			output[name] = group
+			break
+		}
+	}
+
+	return output
+}
@@ -0,0 +1,166 @@
+package sync
+
+import (
+	"context"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userfake "github.com/openshift/client-go/user/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func partialTestConfig(t *testing.T) Config {
+	_, config := controllerTestConfig(t)
+	config.Prune = true
+	config.PruneGroups = true
+
+	// a realm that can't be reached fails
+	broken := newFakeKeycloak(t)
+	broken.realm = "partner"
+	partner := broken.realmConfig()
+	partner.Optional = true
+	broken.server.Close()
+	config.Realms = append(config.Realms, partner)
+
+	return config
+}
+
+func ownedBy(realms string) map[string]string {
+	return map[string]string{
+		constants.AnnotationCreatedBy: constants.CreatedByKeycloakSync,
+		constants.AnnotationRealms:    realms,
+	}
+}
+
+func TestGetKeycloakGroupsOptionalRealm(t *testing.T) {
+	a := assert.New(t)
+
+	config := partialTestConfig(t)
+	groups, err := GetKeycloakGroups(config)
+	partial, isPartial := AsPartialSync(err)
+	a.True(isPartial)
+	a.Equal([]string{"partner"}, partial.FailedRealms())
+	a.Contains(err.Error(), "partner")
+	a.Len(groups, 1)
+	a.Contains(groups, "developers")
+
+	// the same failure in a required realm stops the sync
+	config.Realms[1].Optional = false
+	groups, err = GetKeycloakGroups(config)
+	a.Error(err)
+	_, isPartial = AsPartialSync(err)
+	a.False(isPartial)
+	a.Nil(groups)
+}
+
+func TestGetKeycloakGroupsEmptyRealm(t *testing.T) {
+	a := assert.New(t)
+
+	// a realm that is read and has no groups is not a failure, optional or not
+	_, config := controllerTestConfig(t)
+	empty := newFakeKeycloak(t)
+	empty.realm = "partner"
+	config.Realms = append(config.Realms, empty.realmConfig())
+
+	groups, err := GetKeycloakGroups(config)
+	a.Nil(err)
+	a.Len(groups, 1)
+
+	groups, err = GetKeycloakGroupsFromRealm(config.Realms[1])
+	a.Nil(err)
+	a.Empty(groups)
+}
+
+func TestKeepFailedRealmGroups(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{Prune: true, PruneGroups: true, Realms: []RealmConfig{{Name: "sso"}, {Name: "partner"}}}
+	openshiftGroups := GroupList{
+		"partners": FromOpenShiftGroup(config, *clusterGroup("partners", ownedBy("partner"), "p1")),
+		"shared":   FromOpenShiftGroup(config, *clusterGroup("shared", ownedBy("sso,partner"), "p1", "s1")),
+		"stale":    FromOpenShiftGroup(config, *clusterGroup("stale", ownedBy("sso"), "s1")),
+	}
+	keycloakGroups := GroupList{
+		"shared": realmGroup("sso", "shared", "s2"),
+	}
+
+	kept := KeepFailedRealmGroups(openshiftGroups, []string{"partner"})
+	a.True(kept["partners"].Kept)
+	a.True(kept["shared"].Kept)
+	a.False(kept["stale"].Kept)
+	// the groups that were given are not changed
+	a.False(openshiftGroups["partners"].Kept)
+	a.True(openshiftGroups["shared"].Users["p1"].Prune)
+
+	merged := Merge(kept, keycloakGroups)
+	deletions := make([]string, 0)
+	for _, group := range merged.ToOpenShiftGroupDeletions(config).Items {
+		deletions = append(deletions, group.Name)
+	}
+	a.Equal([]string{"stale"}, deletions)
+
+	// users are added to a kept group but none are pruned
+	for _, group := range merged.ToOpenShiftGroups(config, true).Items {
+		a.Equal("shared", group.Name)
+		a.ElementsMatch([]string{"p1", "s1", "s2"}, group.Users)
+	}
+}
+
+func TestReconcileMembersPastDeadline(t *testing.T) {
+	a := assert.New(t)
+
+	// an optional realm that stalls while its members are read
+	_, config := controllerTestConfig(t)
+	config.Prune = true
+	config.PruneGroups = true
+	slow := newFakeKeycloak(t)
+	slow.realm = "partner"
+	group := fakeGroup("partners", "")
+	slow.groups = append(slow.groups, &group)
+	slow.members[*group.ID] = fakeUsers("p", 2)
+	slow.membersDelay = 5 * time.Second
+	partner := slow.realmConfig()
+	partner.Optional = true
+	partner.Deadline = 200 * time.Millisecond
+	config.Realms = append(config.Realms, partner)
+
+	client := userfake.NewSimpleClientset(clusterGroup("partners", ownedBy("partner"), "p0", "p1", "former"))
+
+	sessions := NewKeycloakSessions()
+	defer sessions.Close()
+	_, err := Reconcile(context.Background(), config, sessions, client)
+	partial, isPartial := AsPartialSync(err)
+	a.True(isPartial)
+	a.Equal([]string{"partner"}, partial.FailedRealms())
+
+	// no users are pruned from the group of the realm that did not finish
+	partners, err := client.UserV1().Groups().Get(context.Background(), "partners", v1.GetOptions{})
+	a.Nil(err)
+	a.ElementsMatch([]string{"p0", "p1", "former"}, partners.Users)
+}
+
+func TestReconcileOptionalRealm(t *testing.T) {
+	a := assert.New(t)
+
+	config := partialTestConfig(t)
+	client := userfake.NewSimpleClientset(
+		clusterGroup("developers", ownedBy(config.Realms[0].Name), "dev0", "gone"),
+		clusterGroup("partners", ownedBy("partner"), "p1", "p2"),
+	)
+
+	sessions := NewKeycloakSessions()
+	defer sessions.Close()
+	result, err := Reconcile(context.Background(), config, sessions, client)
+	_, isPartial := AsPartialSync(err)
+	a.True(isPartial)
+	a.Equal([]string{"developers"}, result.Updated)
+	a.Empty(result.Deleted)
+
+	developers, err := client.UserV1().Groups().Get(context.Background(), "developers", v1.GetOptions{})
+	a.Nil(err)
+	a.ElementsMatch([]string{"dev0", "dev1", "dev2"}, developers.Users)
+	partners, err := client.UserV1().Groups().Get(context.Background(), "partners", v1.GetOptions{})
+	a.Nil(err)
+	a.ElementsMatch([]string{"p1", "p2"}, partners.Users)
+}
@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"encoding/json"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userapi "github.com/openshift/api/user/v1"
+	"sort"
+	"time"
+)
+
+/**
+ * GroupSource records the keycloak group (or role) that a group was made from
+ */
+type GroupSource struct {
+	Realm string `json:"realm"`
+	// the url of the realm, the same as the issuer of its tokens
+	URL string `json:"url"`
+	// the keycloak id of the group or role
+	ID string `json:"id"`
+	// the keycloak path of the group, empty for roles
+	Path string `json:"path,omitempty"`
+	// the name of the role, empty for groups
+	Role string `json:"role,omitempty"`
+}
+
+// the provenance annotations are replaced as a whole, one that is no longer needed is removed from the group
+var provenanceKeys = []string{constants.AnnotationSources, constants.AnnotationUserSources}
+
+/**
+ * provenanceAnnotations returns the annotations that record where the group and its users came from in keycloak.
+ *                       the sync timestamp is not included so that the annotations only change when the sources
+ *                       do.
+ */
+func provenanceAnnotations(group Group) map[string]string {
+	annotations := make(map[string]string)
+	if len(group.Sources) > 0 {
+		if data, err := json.Marshal(sortedSources(group.Sources)); err == nil {
+			annotations[constants.AnnotationSources] = string(data)
+		}
+	}
+	userSources := make(map[string]string)
+	for _, user := range group.Users {
+		if len(user.Via) > 0 {
+			userSources[user.Name] = user.Via
+		}
+	}
+	if len(userSources) > 0 {
+		// the keys of a map are sorted when it is encoded so the value is the same for the same users
+		if data, err := json.Marshal(userSources); err == nil {
+			annotations[constants.AnnotationUserSources] = string(data)
+		}
+	}
+	return annotations
+}
+
+/**
+ * sortedSources returns a copy of the sources sorted by realm, path, role, and id so that the order that the realms
+ *               and groups were merged in does not change the annotation
+ */
+func sortedSources(sources []GroupSource) []GroupSource {
+	sorted := make([]GroupSource, len(sources))
+	copy(sorted, sources)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		first, second := sorted[i], sorted[j]
+		if first.Realm != second.Realm {
+			return first.Realm < second.Realm
+		}
+		if first.Path != second.Path {
+			return first.Path < second.Path
+		}
+		if first.Role != second.Role {
+			return first.Role < second.Role
+		}
+		return first.ID < second.ID
+	})
+	return sorted
+}
+
+/**
+ * WithSyncedAt returns a copy of the groups with the time that the keycloak groups they were made from were read.
+ *              it is always set on groups that are applied to the cluster. the groups that are written out only
+ *              have it with the "synced-at" option because it changes every run and the same groups are otherwise
+ *              written the same way each time.
+ */
+func (sgs GroupList) WithSyncedAt(groups userapi.GroupList) userapi.GroupList {
+	output := *groups.DeepCopy()
+	for idx := range output.Items {
+		item := &output.Items[idx]
+		group, found := sgs[item.Name]
+		if !found || group.SyncedAt.IsZero() {
+			continue
+		}
+		if item.Annotations == nil {
+			item.Annotations = make(map[string]string)
+		}
+		item.Annotations[constants.AnnotationSyncedAt] = group.SyncedAt.UTC().Format(time.RFC3339)
+	}
+	return output
+}
+
+/**
+ * latestSync returns the later of the two sync times
+ */
+func latestSync(first time.Time, second time.Time) time.Time {
+	if second.After(first) {
+		return second
+	}
+	return first
+}
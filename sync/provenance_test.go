@@ -0,0 +1,102 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	userapi "github.com/openshift/api/user/v1"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	ops := fakeGroup("ops", "/platform")
+	platform := fakeGroup("platform", "", ops)
+	fake.groups = append(fake.groups, &platform)
+	fake.members[*platform.ID] = fakeUsers("lead", 1)
+	fake.members[*ops.ID] = fakeUsers("ops", 2)
+
+	realm := fake.realmConfig()
+	realm.Subgroups = true
+	realm.SubgroupConcat = true
+	realm.SubgroupUsers = true
+
+	before := time.Now()
+	session := newKeycloakSession(realm)
+	defer session.close()
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+
+	group := groups["platform"]
+	a.Equal([]GroupSource{{Realm: "sso", URL: fake.server.URL + "/auth/realms/sso", ID: *platform.ID, Path: "/platform"}}, group.Sources)
+	a.False(group.SyncedAt.Before(before.Truncate(time.Second)))
+	a.Equal("", group.Users["lead0"].Via)
+	a.Equal("/platform/ops", group.Users["ops0"].Via)
+	a.Equal("", groups["platform.ops"].Users["ops0"].Via)
+
+	openshiftGroup, _ := group.ToOpenShiftGroup(Config{})
+	sources := make([]GroupSource, 0)
+	a.Nil(json.Unmarshal([]byte(openshiftGroup.Annotations[constants.AnnotationSources]), &sources))
+	a.Equal(group.Sources, sources)
+	a.Equal(`{"ops0":"/platform/ops","ops1":"/platform/ops"}`, openshiftGroup.Annotations[constants.AnnotationUserSources])
+
+	// the sync time is only set on groups that are applied
+	_, found := openshiftGroup.Annotations[constants.AnnotationSyncedAt]
+	a.False(found)
+	applied := GroupList(groups).WithSyncedAt(userapi.GroupList{Items: []userapi.Group{openshiftGroup}})
+	syncedAt, err := time.Parse(time.RFC3339, applied.Items[0].Annotations[constants.AnnotationSyncedAt])
+	a.Nil(err)
+	a.Equal(group.SyncedAt.Unix(), syncedAt.Unix())
+	_, found = openshiftGroup.Annotations[constants.AnnotationSyncedAt]
+	a.False(found)
+
+	// a group without promoted users does not have the user sources
+	opsGroup := groups["platform.ops"]
+	openshiftGroup, _ = opsGroup.ToOpenShiftGroup(Config{})
+	_, found = openshiftGroup.Annotations[constants.AnnotationUserSources]
+	a.False(found)
+}
+
+func TestProvenanceChanges(t *testing.T) {
+	a := assert.New(t)
+
+	keycloakGroup := Group{
+		Name:     "platform",
+		Source:   "realm:sso",
+		Realms:   []string{"sso"},
+		Sources:  []GroupSource{{Realm: "sso", URL: "https://sso.example.com/auth/realms/sso", ID: "id-platform", Path: "/platform"}},
+		SyncedAt: time.Now(),
+		Users:    map[string]User{"alice": {Name: "alice", Via: "/platform/ops"}},
+	}
+	written, _ := keycloakGroup.ToOpenShiftGroup(Config{})
+
+	// the same group read back from openshift is not changed, the sync time alone does not change it
+	current := GroupList{"platform": FromOpenShiftGroup(Config{}, written)}
+	keycloakGroup.SyncedAt = keycloakGroup.SyncedAt.Add(time.Hour)
+	merged := Merge(current, GroupList{"platform": keycloakGroup})
+	a.False(merged["platform"].Changed)
+
+	// the user now comes from another subgroup
+	moved := keycloakGroup.copy()
+	moved.Users["alice"] = User{Name: "alice", Via: "/platform/db"}
+	merged = Merge(current, GroupList{"platform": moved})
+	a.True(merged["platform"].Changed)
+	a.Equal("/platform/db", merged["platform"].Users["alice"].Via)
+
+	// a group written before the provenance annotations is changed so that it gets them
+	old := userapi.Group{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "platform",
+			Labels:      written.Labels,
+			Annotations: map[string]string{constants.AnnotationCreatedBy: constants.CreatedByKeycloakSync},
+		},
+		Users: userapi.OptionalNames{"alice"},
+	}
+	merged = Merge(GroupList{"platform": FromOpenShiftGroup(Config{}, old)}, GroupList{"platform": keycloakGroup})
+	a.True(merged["platform"].Changed)
+}
@@ -0,0 +1,400 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+/**
+ * keycloakRole identifies a realm role or, when the client id is set, a client role
+ */
+type keycloakRole struct {
+	id   string
+	name string
+	// the internal id of the client that the role belongs to, empty for realm roles
+	clientID string
+}
+
+func toKeycloakRole(role *gocloak.Role) (keycloakRole, bool) {
+	if role == nil || role.ID == nil || role.Name == nil {
+		return keycloakRole{}, false
+	}
+	output := keycloakRole{
+		id:   *role.ID,
+		name: *role.Name,
+	}
+	if role.ClientRole != nil && *role.ClientRole && role.ContainerID != nil {
+		output.clientID = *role.ContainerID
+	}
+	return output, true
+}
+
+/**
+ * isNotFound is true when keycloak answered that the requested object does not exist
+ */
+func isNotFound(err error) bool {
+	apiError, ok := err.(*gocloak.APIError)
+	return ok && apiError.Code == http.StatusNotFound
+}
+
+/**
+ * url returns the admin api url for the role, or for the path under the role if parts are given
+ */
+func (role keycloakRole) url(realm RealmConfig, parts ...string) string {
+	if len(role.clientID) > 0 {
+		return adminUrl(realm, append([]string{"clients", role.clientID, "roles", role.name}, parts...)...)
+	}
+	return adminUrl(realm, append([]string{"roles", role.name}, parts...)...)
+}
+
+/**
+ * keycloakRoleGroup is a role that is synchronized as a group. the members of the group are the users that hold
+ *                   any of the granting roles, which are the role itself and every composite role that includes it.
+ */
+type keycloakRoleGroup struct {
+	role keycloakRole
+	// the name of the group before the prefix, suffix, or alias is applied
+	name string
+	// the keycloak attributes of the role
+	attributes *map[string][]string
+	granting   []keycloakRole
+}
+
+/**
+ * getRoleGroupsForRealm finds the roles selected in the realm configuration and the composite roles that grant
+ *                       them. composite roles are followed through the realm roles and the roles of the clients
+ *                       named in the configuration. roles and clients that keycloak says do not exist are skipped
+ *                       with a warning and any other error is returned so that the role groups are not pruned.
+ */
+func getRoleGroupsForRealm(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, accessToken string) ([]keycloakRoleGroup, error) {
+	selected := make([]keycloakRoleGroup, 0)
+	for _, roleName := range realm.Roles.Realm {
+		if len(roleName) < 1 {
+			continue
+		}
+		found, err := client.GetRealmRole(ctx, accessToken, realm.Name, roleName)
+		if err != nil && !isNotFound(err) {
+			return nil, fmt.Errorf("could not get realm role named %s: %s", roleName, err)
+		}
+		role, ok := toKeycloakRole(found)
+		if err != nil || !ok {
+			logrus.Warnf("realm %s | could not get realm role named %s", realm.Name, roleName)
+			continue
+		}
+		selected = append(selected, keycloakRoleGroup{
+			role:       role,
+			name:       roleName,
+			attributes: found.Attributes,
+		})
+	}
+
+	// sort the client ids so that the roles are found in the same order every time
+	clientIds := make([]string, 0, len(realm.Roles.Clients))
+	for clientId := range realm.Roles.Clients {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+
+	// client ids to the internal id of the client
+	clients := make(map[string]string)
+	for _, clientId := range clientIds {
+		clientId := clientId
+		found, err := client.GetClients(ctx, accessToken, realm.Name, gocloak.GetClientsParams{
+			ClientID: &clientId,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not get client %s: %s", clientId, err)
+		}
+		for _, foundClient := range found {
+			if foundClient != nil && foundClient.ID != nil && foundClient.ClientID != nil && *foundClient.ClientID == clientId {
+				clients[clientId] = *foundClient.ID
+				break
+			}
+		}
+		if _, found := clients[clientId]; !found {
+			logrus.Warnf("realm %s | could not find client %s for roles", realm.Name, clientId)
+			continue
+		}
+
+		for _, roleName := range realm.Roles.Clients[clientId] {
+			if len(roleName) < 1 {
+				continue
+			}
+			found, err := client.GetClientRole(ctx, accessToken, realm.Name, clients[clientId], roleName)
+			if err != nil && !isNotFound(err) {
+				return nil, fmt.Errorf("could not get role named %s for client %s: %s", roleName, clientId, err)
+			}
+			role, ok := toKeycloakRole(found)
+			if err != nil || !ok {
+				logrus.Warnf("realm %s | could not get role named %s for client %s", realm.Name, roleName, clientId)
+				continue
+			}
+			// the client role response does not always say which client it is from
+			role.clientID = clients[clientId]
+			selected = append(selected, keycloakRoleGroup{
+				role:       role,
+				name:       clientId + realm.GetSubgroupSeparator() + roleName,
+				attributes: found.Attributes,
+			})
+		}
+	}
+
+	if len(selected) < 1 {
+		return selected, nil
+	}
+
+	// map each role to the composite roles that include it
+	parents, err := getCompositeParents(ctx, client, realm, accessToken, clients)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range selected {
+		selected[idx].granting = grantingRoles(selected[idx].role, parents)
+	}
+
+	return selected, nil
+}
+
+/**
+ * getCompositeParents returns a map of role id to the composite roles that directly include the role
+ */
+func getCompositeParents(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, accessToken string, clients map[string]string) (map[string][]keycloakRole, error) {
+	roles, err := client.GetRealmRoles(ctx, accessToken, realm.Name)
+	if err != nil {
+		return nil, err
+	}
+	clientIds := make([]string, 0, len(clients))
+	for clientId := range clients {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+	for _, clientId := range clientIds {
+		clientRoles, err := client.GetClientRoles(ctx, accessToken, realm.Name, clients[clientId])
+		if err != nil {
+			return nil, err
+		}
+		for _, clientRole := range clientRoles {
+			// the container is the client but the role list does not always say so
+			if clientRole != nil && clientRole.ContainerID == nil {
+				clientRole.ContainerID = gocloak.StringP(clients[clientId])
+			}
+		}
+		roles = append(roles, clientRoles...)
+	}
+
+	parents := make(map[string][]keycloakRole)
+	for _, role := range roles {
+		parent, ok := toKeycloakRole(role)
+		if !ok || role.Composite == nil || !*role.Composite {
+			continue
+		}
+		var composites []*gocloak.Role
+		resp, err := client.RestyClient().R().
+			SetContext(ctx).
+			SetAuthToken(accessToken).
+			SetResult(&composites).
+			Get(adminUrl(realm, "roles-by-id", parent.id, "composites"))
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("could not get composites of role %s from realm %s: %s", parent.name, realm.Name, resp.Status())
+		}
+		for _, composite := range composites {
+			child, ok := toKeycloakRole(composite)
+			if !ok {
+				continue
+			}
+			parents[child.id] = append(parents[child.id], parent)
+		}
+	}
+
+	return parents, nil
+}
+
+/**
+ * grantingRoles returns the role and every composite role that includes it, directly or through another composite
+ */
+func grantingRoles(role keycloakRole, parents map[string][]keycloakRole) []keycloakRole {
+	granting := []keycloakRole{role}
+	seen := map[string]bool{role.id: true}
+	for idx := 0; idx < len(granting); idx++ {
+		for _, parent := range parents[granting[idx].id] {
+			if seen[parent.id] {
+				continue
+			}
+			seen[parent.id] = true
+			granting = append(granting, parent)
+		}
+	}
+	return granting
+}
+
+/**
+ * getUsersForRole returns the users that hold any of the granting roles of the role group, either directly or
+ *                 through membership in a group (or a subgroup of a group) that has the role
+ */
+func getUsersForRole(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, roleGroup keycloakRoleGroup, accessToken string) ([]*gocloak.User, error) {
+	users := make([]*gocloak.User, 0)
+	seenUsers := make(map[string]bool)
+	addUsers := func(found []*gocloak.User) {
+		for _, user := range found {
+			if user == nil || user.ID == nil || seenUsers[*user.ID] {
+				continue
+			}
+			seenUsers[*user.ID] = true
+			users = append(users, user)
+		}
+	}
+
+	seenGroups := make(map[string]bool)
+	for _, role := range roleGroup.granting {
+		// users that have the role mapped to them
+		roleUsers, err := getRoleUsers(ctx, client, realm, role, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		addUsers(roleUsers)
+
+		// groups that have the role mapped to them, the members of their subgroups inherit the role
+		roleGroups, err := getRoleGroups(ctx, client, realm, role, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range roleGroups {
+			if group == nil || group.ID == nil || seenGroups[*group.ID] {
+				continue
+			}
+			groupIds, err := getGroupTree(ctx, client, realm, accessToken, *group.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, groupId := range groupIds {
+				if seenGroups[groupId] {
+					continue
+				}
+				seenGroups[groupId] = true
+				members, err := getUsersForGroup(ctx, client, realm, Group{Id: groupId, Name: groupId}, accessToken)
+				if err != nil {
+					return nil, err
+				}
+				addUsers(members)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+/**
+ * getRoleUsers returns the users that have the role mapped to them directly
+ */
+func getRoleUsers(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, role keycloakRole, accessToken string) ([]*gocloak.User, error) {
+	users := make([]*gocloak.User, 0)
+	err := paginate(realm.GetPageSize(), func(first int, max int) (int, error) {
+		var page []*gocloak.User
+		resp, err := client.RestyClient().R().
+			SetContext(ctx).
+			SetAuthToken(accessToken).
+			SetQueryParams(map[string]string{
+				"first":               strconv.Itoa(first),
+				"max":                 strconv.Itoa(max),
+				"briefRepresentation": "false",
+			}).
+			SetResult(&page).
+			Get(role.url(realm, "users"))
+		if err != nil {
+			return 0, err
+		}
+		if resp.IsError() {
+			return 0, fmt.Errorf("could not get users with role %s from realm %s: %s", role.name, realm.Name, resp.Status())
+		}
+		users = append(users, page...)
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+/**
+ * getRoleGroups returns the groups that have the role mapped to them directly
+ */
+func getRoleGroups(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, role keycloakRole, accessToken string) ([]*gocloak.Group, error) {
+	groups := make([]*gocloak.Group, 0)
+	err := paginate(realm.GetPageSize(), func(first int, max int) (int, error) {
+		var page []*gocloak.Group
+		resp, err := client.RestyClient().R().
+			SetContext(ctx).
+			SetAuthToken(accessToken).
+			SetQueryParams(map[string]string{
+				"first": strconv.Itoa(first),
+				"max":   strconv.Itoa(max),
+			}).
+			SetResult(&page).
+			Get(role.url(realm, "groups"))
+		if err != nil {
+			return 0, err
+		}
+		if resp.IsError() {
+			return 0, fmt.Errorf("could not get groups with role %s from realm %s: %s", role.name, realm.Name, resp.Status())
+		}
+		groups = append(groups, page...)
+		return len(page), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+/**
+ * getGroupTree returns the id of the group and the ids of all of its subgroups
+ */
+func getGroupTree(ctx context.Context, client gocloak.GoCloak, realm RealmConfig, accessToken string, groupID string) ([]string, error) {
+	group, err := client.GetGroup(ctx, accessToken, realm.Name, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	// older versions of keycloak return the whole tree with the group
+	if group.SubGroups != nil && len(*group.SubGroups) > 0 {
+		ids := make([]string, 0)
+		pending := []gocloak.Group{*group}
+		for len(pending) > 0 {
+			next := pending[0]
+			pending = pending[1:]
+			if next.ID != nil {
+				ids = append(ids, *next.ID)
+			}
+			if next.SubGroups != nil {
+				pending = append(pending, *next.SubGroups...)
+			}
+		}
+		return ids, nil
+	}
+
+	// newer versions need the children to be requested for each group
+	ids := []string{groupID}
+	for idx := 0; idx < len(ids); idx++ {
+		subGroups, err := getSubGroups(ctx, client, realm, accessToken, ids[idx])
+		if err == errSubGroupsUnsupported && idx == 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, subGroup := range subGroups {
+			if subGroup.ID != nil {
+				ids = append(ids, *subGroup.ID)
+			}
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"context"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/chrisruffalo/keycloak-sync/constants"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func fakeRole(name string, clientID string, composite bool) *gocloak.Role {
+	id := "role-" + name
+	if len(clientID) > 0 {
+		id = "role-" + clientID + "-" + name
+	}
+	return &gocloak.Role{
+		ID:          &id,
+		Name:        &name,
+		Composite:   &composite,
+		ClientRole:  gocloak.BoolP(len(clientID) > 0),
+		ContainerID: &clientID,
+	}
+}
+
+func TestGrantingRolesFollowsComposites(t *testing.T) {
+	a := assert.New(t)
+
+	viewer := keycloakRole{id: "viewer", name: "viewer"}
+	editor := keycloakRole{id: "editor", name: "editor"}
+	admin := keycloakRole{id: "admin", name: "admin"}
+	parents := map[string][]keycloakRole{
+		"viewer": {editor},
+		"editor": {admin},
+		// a cycle between composites does not loop forever
+		"admin": {editor},
+	}
+
+	a.Equal([]keycloakRole{viewer, editor, admin}, grantingRoles(viewer, parents))
+	a.Equal([]keycloakRole{admin, editor}, grantingRoles(admin, parents))
+}
+
+func TestGetGroupsAndUsersForRealmRoles(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+
+	// a realm role, a composite realm role that includes it, and a client with a composite role that includes it
+	viewer := fakeRole("viewer", "", false)
+	admin := fakeRole("admin", "", true)
+	fake.roles = append(fake.roles, viewer, admin)
+	fake.clients["console"] = "console-id"
+	operator := fakeRole("operator", "console-id", true)
+	deploy := fakeRole("deploy", "console-id", false)
+	fake.clientRoles["console-id"] = []*gocloak.Role{operator, deploy}
+	fake.composites[*admin.ID] = []*gocloak.Role{viewer}
+	fake.composites[*operator.ID] = []*gocloak.Role{viewer}
+
+	// viewer is held directly, admin is held through a group with a subgroup, and operator is held directly
+	oncall := fakeGroup("oncall", "/ops")
+	ops := fakeGroup("ops", "", oncall)
+	fake.groups = append(fake.groups, &ops)
+	fake.members[*ops.ID] = fakeUsers("ops", 2)
+	fake.members[*oncall.ID] = fakeUsers("oncall", 3)
+	fake.roleUsers[*viewer.ID] = fakeUsers("viewer", 4)
+	fake.roleGroups[*admin.ID] = []*gocloak.Group{&ops}
+	fake.roleUsers[*operator.ID] = fakeUsers("operator", 1)
+	fake.roleUsers[*deploy.ID] = fakeUsers("deploy", 2)
+
+	realm := fake.realmConfig()
+	realm.GroupPrefix = "sso-"
+	realm.Aliases = map[string]string{"console.deploy": "deployers"}
+	realm.Roles = RoleConfig{
+		Realm:   []string{"viewer", "missing"},
+		Clients: map[string][]string{"console": {"deploy"}},
+	}
+
+	session := newKeycloakSession(realm)
+	defer session.close()
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+
+	// the ops group is still synchronized as a group
+	a.Equal(2, len(groups["sso-ops"].Users))
+
+	// everyone that holds viewer directly, through the admin group tree, or through the operator composite
+	viewers := groups["sso-viewer"]
+	a.Equal(4+2+3+1, len(viewers.Users))
+	a.Contains(viewers.Users, "oncall2")
+	a.Contains(viewers.Users, "operator0")
+	a.Equal("role:sso", viewers.Source)
+	a.Equal([]string{"sso"}, viewers.Realms)
+
+	// client roles are named with the client id and use the aliases
+	a.Equal(2, len(groups["deployers"].Users))
+
+	openshiftGroup, _ := viewers.ToOpenShiftGroup(Config{})
+	a.Equal("role:sso", openshiftGroup.Annotations[constants.AnnotationPrimarySource])
+}
+
+func TestGetGroupsAndUsersForRealmRoleErrors(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	viewer := fakeRole("viewer", "", false)
+	fake.roles = append(fake.roles, viewer)
+	fake.clients["console"] = "console-id"
+	fake.clientRoles["console-id"] = []*gocloak.Role{fakeRole("deploy", "console-id", false)}
+
+	realm := fake.realmConfig()
+	collect := func(roles RoleConfig) (GroupList, error) {
+		realm.Roles = roles
+		session := newKeycloakSession(realm)
+		defer session.close()
+		return getGroupsAndUsersForRealm(context.Background(), session)
+	}
+
+	// roles and clients that do not exist are skipped
+	groups, err := collect(RoleConfig{Realm: []string{"viewer", "missing"}, Clients: map[string][]string{"console": {"missing"}, "other": {"deploy"}}})
+	a.Nil(err)
+	a.Equal(1, len(groups))
+
+	// any other error fails the realm so that the role groups are not pruned
+	fake.roleStatus = map[string]int{"viewer": http.StatusInternalServerError}
+	_, err = collect(RoleConfig{Realm: []string{"viewer"}})
+	a.Error(err)
+	a.Contains(err.Error(), "could not get realm role named viewer")
+
+	fake.roleStatus = map[string]int{"deploy": http.StatusBadGateway}
+	_, err = collect(RoleConfig{Clients: map[string][]string{"console": {"deploy"}}})
+	a.Error(err)
+	a.Contains(err.Error(), "could not get role named deploy for client console")
+}
@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	RuleInclude = "include"
+	RuleExclude = "exclude"
+)
+
+/**
+ * groupRule is the compiled form of a single group rule
+ */
+type groupRule struct {
+	include bool
+	pattern *regexp.Regexp
+	// the configured glob or regex, used in log messages
+	description string
+}
+
+/**
+ * groupRules selects the groups from a realm using include and exclude rules that are evaluated in order
+ */
+type groupRules struct {
+	rules []groupRule
+	// the result when no rule matches
+	fallback bool
+}
+
+/**
+ * newGroupRules compiles the group rules for a realm. when no rule matches a group it is selected unless there
+ *               is at least one include rule, so a list of only exclude rules removes groups and a list with an
+ *               include rule only selects what is included.
+ */
+func newGroupRules(configs []GroupRuleConfig) (*groupRules, error) {
+	rules := &groupRules{
+		rules:    make([]groupRule, 0, len(configs)),
+		fallback: true,
+	}
+	for _, config := range configs {
+		rule := groupRule{
+			include: strings.ToLower(config.Action) != RuleExclude,
+		}
+		var err error
+		if len(config.Path) > 0 {
+			rule.pattern, err = globToRegexp(config.Path)
+			rule.description = config.Path
+		} else {
+			rule.pattern, err = regexp.Compile(config.Regex)
+			rule.description = config.Regex
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid group rule %s: %s", rule.description, err)
+		}
+		if rule.include {
+			rules.fallback = false
+		}
+		rules.rules = append(rules.rules, rule)
+	}
+	return rules, nil
+}
+
+/**
+ * selected returns true if the group with the given keycloak path and final name should be synchronized. the
+ *          first rule that matches either the path or the final name decides.
+ */
+func (rules *groupRules) selected(path string, finalName string) (bool, string) {
+	for _, rule := range rules.rules {
+		if rule.pattern.MatchString(path) || rule.pattern.MatchString(finalName) {
+			return rule.include, rule.description
+		}
+	}
+	return rules.fallback, ""
+}
+
+/**
+ * globToRegexp converts a keycloak path glob to an anchored regular expression. "*" matches any characters in a
+ *              single path segment, "**" matches any characters across segments (and when it is followed by a slash it
+ *              matches zero or more whole segments), and "?" matches a single character in a segment.
+ */
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var builder strings.Builder
+	builder.WriteString("^")
+	for idx := 0; idx < len(glob); idx++ {
+		switch {
+		case glob[idx:] == "/**":
+			// a trailing "/**" also matches the parent so "/platform/**" matches "/platform"
+			builder.WriteString("(?:/.*)?")
+			idx += 2
+		case strings.HasPrefix(glob[idx:], "**/"):
+			builder.WriteString("(?:.*/)?")
+			idx += 2
+		case strings.HasPrefix(glob[idx:], "**"):
+			builder.WriteString(".*")
+			idx++
+		case glob[idx] == '*':
+			builder.WriteString("[^/]*")
+		case glob[idx] == '?':
+			builder.WriteString("[^/]")
+		default:
+			builder.WriteString(regexp.QuoteMeta(glob[idx : idx+1]))
+		}
+	}
+	builder.WriteString("$")
+	return regexp.Compile(builder.String())
+}
@@ -0,0 +1,97 @@
+package sync
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	a := assert.New(t)
+
+	matches := func(glob string, path string) bool {
+		pattern, err := globToRegexp(glob)
+		a.Nil(err)
+		return pattern.MatchString(path)
+	}
+
+	a.True(matches("/teams/*/admins", "/teams/blue/admins"))
+	a.False(matches("/teams/*/admins", "/teams/blue/east/admins"))
+	a.False(matches("/teams/*/admins", "/teams/blue/admins/db"))
+	a.True(matches("/platform/**", "/platform/db/oracle"))
+	a.True(matches("/platform/**", "/platform"))
+	a.False(matches("/platform/**", "/platforms"))
+	a.True(matches("/platform/**", "/platform/"))
+	a.True(matches("/**/admins", "/admins"))
+	a.True(matches("/**/admins", "/teams/blue/admins"))
+	a.True(matches("/team?", "/team1"))
+	a.False(matches("/team?", "/team/"))
+	a.True(matches("sso-*", "sso-developers"))
+	a.False(matches("/teams.*", "/teamsx"))
+}
+
+func TestGroupRulesFirstMatch(t *testing.T) {
+	a := assert.New(t)
+
+	rules, err := newGroupRules([]GroupRuleConfig{
+		{Action: RuleExclude, Path: "/teams/*/interns"},
+		{Action: RuleInclude, Path: "/teams/**"},
+		{Action: RuleInclude, Regex: "^sso-platform-"},
+	})
+	a.Nil(err)
+
+	selected, rule := rules.selected("/teams/blue/interns", "sso-blue.interns")
+	a.False(selected)
+	a.Equal("/teams/*/interns", rule)
+	selected, _ = rules.selected("/teams/blue/admins", "sso-blue.admins")
+	a.True(selected)
+	// the final name is matched as well as the path
+	selected, _ = rules.selected("/platform", "sso-platform-")
+	a.True(selected)
+	// with an include rule groups that don't match any rule are not selected
+	selected, rule = rules.selected("/other", "sso-other")
+	a.False(selected)
+	a.Equal("", rule)
+
+	// with only exclude rules groups that don't match are selected
+	rules, err = newGroupRules([]GroupRuleConfig{{Action: RuleExclude, Regex: "interns$"}})
+	a.Nil(err)
+	selected, _ = rules.selected("/other", "sso-other")
+	a.True(selected)
+	selected, _ = rules.selected("/teams/blue/interns", "sso-blue.interns")
+	a.False(selected)
+
+	_, err = newGroupRules([]GroupRuleConfig{{Action: RuleInclude, Regex: "("}})
+	a.Error(err)
+}
+
+func TestGetGroupsAndUsersForRealmGroupRules(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	teams := fakeGroup("teams", "",
+		fakeGroup("blue", "/teams", fakeGroup("admins", "/teams/blue"), fakeGroup("interns", "/teams/blue")),
+		fakeGroup("green", "/teams", fakeGroup("admins", "/teams/green"), fakeGroup("interns", "/teams/green")),
+	)
+	fake.groups = append(fake.groups, &teams)
+
+	realm := fake.realmConfig()
+	realm.Subgroups = true
+	realm.SubgroupConcat = true
+	realm.GroupRules = []GroupRuleConfig{
+		{Action: RuleExclude, Path: "/teams/*/interns"},
+		{Action: RuleInclude, Path: "/teams/*/*"},
+		{Action: RuleInclude, Regex: "^teams\\.green$"},
+	}
+
+	session := newKeycloakSession(realm)
+	defer session.close()
+	groups, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Nil(err)
+
+	names := make([]string, 0)
+	for name := range groups {
+		names = append(names, name)
+	}
+	a.ElementsMatch([]string{"teams.blue.admins", "teams.green.admins", "teams.green"}, names)
+}
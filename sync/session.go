@@ -0,0 +1,233 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	gosync "sync"
+	"time"
+)
+
+// tokens are renewed when they are this close to expiring so that they don't expire in the middle of a sync
+const tokenExpiryMargin = 30 * time.Second
+
+/**
+ * keycloakSession holds the client and token for a single realm so that they can be used for more than one
+ *                 sync. the token is refreshed or the session logs in again when the token is close to expiring.
+ */
+type keycloakSession struct {
+	realm  RealmConfig
+	client gocloak.GoCloak
+	// set when the client could not be configured, the session can't be used
+	setupErr error
+	// reads credentials that are kept in a Kubernetes Secret, nil when not applying to the cluster
+	secrets SecretReader
+
+	mutex          gosync.Mutex
+	token          *gocloak.JWT
+	expires        time.Time
+	refreshExpires time.Time
+	// the realm with the credentials that the token was issued with, used to refresh the token and log out
+	credentials RealmConfig
+}
+
+func newKeycloakSession(realm RealmConfig) *keycloakSession {
+	// create client for realm
+	client := gocloak.NewClient(realm.Url)
+	restyClient := client.RestyClient()
+	if viper.GetBool("keycloak-debug") {
+		restyClient.SetDebug(true)
+	}
+
+	// the tls and proxy settings are applied to the transport before it is wrapped. a problem with them (like a
+	// CA bundle that can't be read) is returned when the session is used.
+	var setupErr error
+	if transport, ok := restyClient.GetClient().Transport.(*http.Transport); ok {
+		setupErr = configureTransport(realm, transport)
+	} else {
+		setupErr = fmt.Errorf("realm %s: the keycloak client does not have an http transport to configure", realm.Name)
+	}
+
+	// count and time every request, this wraps the transport so it must be done after the transport is configured.
+	// the limits of the realm wrap that so that each attempt of a retried request is counted.
+	instrumented := metrics.InstrumentTransport(realm.Name, restyClient.GetClient().Transport)
+	restyClient.SetTransport(newKeycloakTransport(realm, instrumented))
+
+	return &keycloakSession{
+		realm:    realm,
+		client:   client,
+		setupErr: setupErr,
+	}
+}
+
+/**
+ * accessToken returns an access token for the realm, logging in or refreshing the token as needed
+ */
+func (session *keycloakSession) accessToken(ctx context.Context) (string, error) {
+	if session.setupErr != nil {
+		return "", session.setupErr
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	now := time.Now()
+
+	// the current token is still good
+	if session.token != nil && now.Add(tokenExpiryMargin).Before(session.expires) {
+		return session.token.AccessToken, nil
+	}
+
+	// try to refresh the token before logging in again
+	if session.token != nil && len(session.token.RefreshToken) > 0 && now.Add(tokenExpiryMargin).Before(session.refreshExpires) {
+		token, err := session.refresh(ctx)
+		if err == nil {
+			session.setToken(token, now, session.credentials)
+			return token.AccessToken, nil
+		}
+		logrus.Debugf("realm %s | could not refresh token, logging in again: %s", session.realm.Name, err)
+	}
+
+	// log out of any previous session before starting a new one
+	session.logout()
+
+	// the credentials are read for each login so that a secret that was changed is used
+	realm, err := withCredentials(ctx, session.secrets, session.realm)
+	if err != nil {
+		return "", err
+	}
+
+	// login with client and get token
+	token, err := loginKeyCloak(ctx, session.client, realm)
+	if err != nil {
+		if token != nil && len(token.RefreshToken) > 0 {
+			logoutErr := logoutKeyCloak(session.client, realm, token)
+			if logoutErr != nil {
+				logrus.Warnf("realm %s | could not log out: %s", session.realm.Name, logoutErr)
+			}
+		}
+		return "", err
+	}
+	session.setToken(token, now, realm)
+
+	return token.AccessToken, nil
+}
+
+func (session *keycloakSession) refresh(ctx context.Context) (*gocloak.JWT, error) {
+	realm := session.credentials
+	if realm.ClientConfig != nil && realm.ClientConfig.AuthMethod() != ClientAuthSecret {
+		return refreshClientWithoutSecret(ctx, session.client, realm, session.token.RefreshToken)
+	}
+	if realm.ClientConfig != nil {
+		return session.client.RefreshToken(ctx, session.token.RefreshToken, realm.ClientConfig.ClientId, realm.ClientConfig.ClientSecret, realm.Name)
+	}
+	// admin logins are made through the admin-cli client in the login realm
+	loginRealm := realm.Name
+	if realm.UserConfig != nil && len(realm.UserConfig.LoginRealm) > 0 {
+		loginRealm = realm.UserConfig.LoginRealm
+	}
+	return session.client.RefreshToken(ctx, session.token.RefreshToken, "admin-cli", "", loginRealm)
+}
+
+func (session *keycloakSession) setToken(token *gocloak.JWT, issued time.Time, credentials RealmConfig) {
+	session.token = token
+	session.credentials = credentials
+	session.expires = issued.Add(time.Duration(token.ExpiresIn) * time.Second)
+	session.refreshExpires = issued.Add(time.Duration(token.RefreshExpiresIn) * time.Second)
+}
+
+// logout must be called while holding the session lock
+func (session *keycloakSession) logout() {
+	if session.token == nil {
+		return
+	}
+	err := logoutKeyCloak(session.client, session.credentials, session.token)
+	if err != nil {
+		logrus.Warnf("realm %s | could not log out: %s", session.realm.Name, err)
+	}
+	session.token = nil
+}
+
+/**
+ * close logs out of the session
+ */
+func (session *keycloakSession) close() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.logout()
+}
+
+/**
+ * KeycloakSessions keeps a session open for each realm so that a long running process can reuse the same login
+ *                  for each sync. Close should be called when the sessions are no longer needed.
+ */
+type KeycloakSessions struct {
+	mutex    gosync.Mutex
+	sessions map[string]*keycloakSession
+	secrets  SecretReader
+}
+
+func NewKeycloakSessions() *KeycloakSessions {
+	return &KeycloakSessions{
+		sessions: make(map[string]*keycloakSession),
+	}
+}
+
+/**
+ * sessionKey identifies the session for a realm entry. the session is made with (and keeps) the whole realm
+ *            configuration so two entries for the same realm that are configured differently, like with other
+ *            credentials or tls settings, each get their own session.
+ */
+func sessionKey(realm RealmConfig) string {
+	key := realm.Name + "@" + realm.Url
+	data, err := json.Marshal(realm)
+	if err != nil {
+		return key
+	}
+	sum := sha256.Sum256(data)
+	return key + "#" + hex.EncodeToString(sum[:])
+}
+
+func (sessions *KeycloakSessions) get(realm RealmConfig) *keycloakSession {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	key := sessionKey(realm)
+	session, found := sessions.sessions[key]
+	if !found {
+		session = newKeycloakSession(realm)
+		session.secrets = sessions.secrets
+		sessions.sessions[key] = session
+	}
+	return session
+}
+
+/**
+ * SetSecretReader sets where credentials that are kept in a Kubernetes Secret are read from. it must be set before
+ *                 the sessions are used.
+ */
+func (sessions *KeycloakSessions) SetSecretReader(secrets SecretReader) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	sessions.secrets = secrets
+}
+
+/**
+ * Close logs out of every open session
+ */
+func (sessions *KeycloakSessions) Close() {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	for key, session := range sessions.sessions {
+		session.close()
+		delete(sessions.sessions, key)
+	}
+}
@@ -0,0 +1,150 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the longest time to wait between retries no matter how many retries have been made or what the server asks for
+const maxRetryBackoff = 30 * time.Second
+
+/**
+ * keycloakTransport applies the request limits of a realm to every request made to keycloak. each attempt is
+ *                   rate limited and has its own timeout, and reads (GET and HEAD) that fail with a network
+ *                   error, a 429, or a 5xx response are retried with exponential backoff.
+ */
+type keycloakTransport struct {
+	realm   string
+	next    http.RoundTripper
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	// nil when there is no rate limit
+	limiter *rate.Limiter
+}
+
+func newKeycloakTransport(realm RealmConfig, next http.RoundTripper) *keycloakTransport {
+	transport := &keycloakTransport{
+		realm:   realm.Name,
+		next:    next,
+		timeout: realm.GetRequestTimeout(),
+		retries: realm.Retries,
+		backoff: realm.GetRetryBackoff(),
+	}
+	if realm.RateLimit > 0 {
+		transport.limiter = rate.NewLimiter(rate.Limit(realm.RateLimit), realm.GetRateBurst())
+	}
+	return transport
+}
+
+func (transport *keycloakTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	for attempt := 0; ; attempt++ {
+		if transport.limiter != nil {
+			if err := transport.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := transport.attempt(request)
+		if attempt >= transport.retries || !retryable(request, response, err) {
+			return response, err
+		}
+
+		wait := transport.wait(attempt, response)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = response.Status
+			// the body has to be read and closed so that the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, response.Body)
+			_ = response.Body.Close()
+		}
+		logrus.Debugf("realm %s | retrying %s %s in %s (%d of %d): %s", transport.realm, request.Method, request.URL.Path, wait, attempt+1, transport.retries, reason)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+/**
+ * attempt makes a single request that is cancelled after the request timeout. the timeout is not cancelled
+ *         until the body of the response is closed so that the body can still be read.
+ */
+func (transport *keycloakTransport) attempt(request *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(request.Context(), transport.timeout)
+	response, err := transport.next.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded && request.Context().Err() == nil {
+			return nil, fmt.Errorf("request timed out after %s: %s", transport.timeout, err)
+		}
+		return nil, err
+	}
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+/**
+ * wait returns the time to wait before the next retry. it doubles with each attempt and a Retry-After header with
+ *      a number of seconds is used when it asks for a longer wait.
+ */
+func (transport *keycloakTransport) wait(attempt int, response *http.Response) time.Duration {
+	wait := transport.backoff << uint(attempt)
+	if wait <= 0 || wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	if response != nil {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+		}
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
+
+/**
+ * retryable is true when the request only reads and it failed in a way that could succeed if it is made again.
+ *           requests that were cancelled by their caller are not retried.
+ */
+func retryable(request *http.Request, response *http.Response, err error) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if request.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+}
+
+/**
+ * cancelOnClose cancels the context of a request when the body of the response is closed
+ */
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
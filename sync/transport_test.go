@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+/**
+ * flakyServer fails the first requests with the given status and then answers with "ok"
+ */
+type flakyServer struct {
+	mutex    gosync.Mutex
+	failures int
+	status   int
+	delay    time.Duration
+	requests int
+}
+
+func (server *flakyServer) handle(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	server.requests++
+	fail := server.requests <= server.failures
+	server.mutex.Unlock()
+
+	if fail && server.delay > 0 {
+		time.Sleep(server.delay)
+	}
+	if fail && server.status > 0 {
+		w.WriteHeader(server.status)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+func (server *flakyServer) count() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.requests
+}
+
+func testTransport(t *testing.T, flaky *flakyServer, realm RealmConfig) (*http.Client, string) {
+	server := httptest.NewServer(http.HandlerFunc(flaky.handle))
+	t.Cleanup(server.Close)
+	return &http.Client{Transport: newKeycloakTransport(realm, http.DefaultTransport)}, server.URL
+}
+
+func TestTransportRetriesReads(t *testing.T) {
+	a := assert.New(t)
+
+	flaky := &flakyServer{failures: 2, status: http.StatusServiceUnavailable}
+	client, url := testTransport(t, flaky, RealmConfig{Name: "sso", Retries: 3, RetryBackoff: time.Millisecond})
+
+	response, err := client.Get(url)
+	a.Nil(err)
+	a.Equal(http.StatusOK, response.StatusCode)
+	body, err := ioutil.ReadAll(response.Body)
+	a.Nil(err)
+	a.Nil(response.Body.Close())
+	a.Equal("ok", string(body))
+	a.Equal(3, flaky.count())
+}
+
+func TestTransportGivesUp(t *testing.T) {
+	a := assert.New(t)
+
+	flaky := &flakyServer{failures: 10, status: http.StatusTooManyRequests}
+	client, url := testTransport(t, flaky, RealmConfig{Name: "sso", Retries: 2, RetryBackoff: time.Millisecond})
+
+	response, err := client.Get(url)
+	a.Nil(err)
+	a.Equal(http.StatusTooManyRequests, response.StatusCode)
+	a.Nil(response.Body.Close())
+	a.Equal(3, flaky.count())
+}
+
+func TestTransportDoesNotRetryWrites(t *testing.T) {
+	a := assert.New(t)
+
+	flaky := &flakyServer{failures: 1, status: http.StatusBadGateway}
+	client, url := testTransport(t, flaky, RealmConfig{Name: "sso", Retries: 3, RetryBackoff: time.Millisecond})
+
+	response, err := client.Post(url, "application/x-www-form-urlencoded", strings.NewReader("grant_type=client_credentials"))
+	a.Nil(err)
+	a.Equal(http.StatusBadGateway, response.StatusCode)
+	a.Nil(response.Body.Close())
+	a.Equal(1, flaky.count())
+
+	// client errors are not retried either
+	flaky = &flakyServer{failures: 1, status: http.StatusNotFound}
+	client, url = testTransport(t, flaky, RealmConfig{Name: "sso", Retries: 3, RetryBackoff: time.Millisecond})
+	response, err = client.Get(url)
+	a.Nil(err)
+	a.Equal(http.StatusNotFound, response.StatusCode)
+	a.Nil(response.Body.Close())
+	a.Equal(1, flaky.count())
+}
+
+func TestTransportRequestTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	// the first request is too slow and times out, the retry succeeds
+	flaky := &flakyServer{failures: 1, delay: 200 * time.Millisecond}
+	client, url := testTransport(t, flaky, RealmConfig{Name: "sso", RequestTimeout: 50 * time.Millisecond, Retries: 1, RetryBackoff: time.Millisecond})
+	response, err := client.Get(url)
+	a.Nil(err)
+	a.Nil(response.Body.Close())
+	a.Equal(2, flaky.count())
+
+	// without retries the timeout is returned
+	flaky = &flakyServer{failures: 1, delay: 200 * time.Millisecond}
+	client, url = testTransport(t, flaky, RealmConfig{Name: "sso", RequestTimeout: 50 * time.Millisecond})
+	_, err = client.Get(url)
+	a.Error(err)
+	a.Contains(err.Error(), "timed out after 50ms")
+}
+
+func TestTransportRateLimit(t *testing.T) {
+	a := assert.New(t)
+
+	flaky := &flakyServer{}
+	client, url := testTransport(t, flaky, RealmConfig{Name: "sso", RateLimit: 20, RateBurst: 1})
+
+	start := time.Now()
+	for idx := 0; idx < 5; idx++ {
+		response, err := client.Get(url)
+		a.Nil(err)
+		a.Nil(response.Body.Close())
+	}
+	// the first request is free and the next four wait 50ms each
+	a.True(time.Since(start) >= 190*time.Millisecond)
+}
+
+func TestRealmDeadline(t *testing.T) {
+	a := assert.New(t)
+
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+
+	realm := fake.realmConfig()
+	realm.Deadline = time.Nanosecond
+	session := newKeycloakSession(realm)
+	defer session.close()
+
+	_, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Error(err)
+	a.Contains(err.Error(), "did not finish within the deadline of 1ns")
+}
+
+func TestRealmDeadlineReadingMembers(t *testing.T) {
+	a := assert.New(t)
+
+	// the groups are read in time but the members are not
+	fake := newFakeKeycloak(t)
+	group := fakeGroup("developers", "")
+	fake.groups = append(fake.groups, &group)
+	fake.members[*group.ID] = fakeUsers("dev", 3)
+	fake.membersDelay = 5 * time.Second
+
+	realm := fake.realmConfig()
+	realm.Deadline = 200 * time.Millisecond
+	session := newKeycloakSession(realm)
+	defer session.close()
+
+	_, err := getGroupsAndUsersForRealm(context.Background(), session)
+	a.Error(err)
+	a.Contains(err.Error(), "did not finish within the deadline of 200ms")
+	a.Contains(err.Error(), "group developers")
+}
@@ -1,11 +1,15 @@
 package sync
 
 import (
+	"fmt"
 	"github.com/chrisruffalo/keycloak-sync/constants"
+	"github.com/chrisruffalo/keycloak-sync/metrics"
 	userapi "github.com/openshift/api/user/v1"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
 	"strings"
+	"time"
 )
 
 /**
@@ -40,8 +44,14 @@ func Merge(targetGroup GroupList, sourceGroup GroupList) GroupList {
 		// determine if group is already in map
 		alreadyGroup, alreadyInMap := outputGroup[group.FinalName()]
 		if alreadyInMap {
-			// update realms
+			// update realms and where the group came from
 			alreadyGroup.Realms = append(alreadyGroup.Realms, group.Realms...)
+			alreadyGroup.Sources = append(alreadyGroup.Sources, group.Sources...)
+			alreadyGroup.SyncedAt = latestSync(alreadyGroup.SyncedAt, group.SyncedAt)
+
+			// the labels and annotations from the realm are set on the group
+			alreadyGroup.ManagedLabels = mergeMetadata(alreadyGroup.ManagedLabels, group.ManagedLabels)
+			alreadyGroup.ManagedAnnotations = mergeMetadata(alreadyGroup.ManagedAnnotations, group.ManagedAnnotations)
 			outputGroup[alreadyGroup.FinalName()] = alreadyGroup
 
 			// proceed with merge behavior
@@ -51,6 +61,7 @@ func Merge(targetGroup GroupList, sourceGroup GroupList) GroupList {
 					// update user in map
 					doNotPruneUser := outputGroup[alreadyGroup.FinalName()].Users[user.Name]
 					doNotPruneUser.Prune = false
+					doNotPruneUser.Via = user.Via
 					outputGroup[alreadyGroup.FinalName()].Users[user.Name] = doNotPruneUser
 
 					logrus.Warnf("User %s already found in group %s", user.Name, group.FinalName())
@@ -67,6 +78,12 @@ func Merge(targetGroup GroupList, sourceGroup GroupList) GroupList {
 				// todo: add children
 				// todo: add... parents?
 			}
+
+			// the group is changed if it does not have the labels and annotations from the realm yet
+			if metadataChanged(alreadyGroup) {
+				alreadyGroup.Changed = true
+				outputGroup[alreadyGroup.FinalName()] = alreadyGroup
+			}
 		} else {
 			// not already in map so put it there
 			outputGroup[group.FinalName()] = group
@@ -76,12 +93,61 @@ func Merge(targetGroup GroupList, sourceGroup GroupList) GroupList {
 	return outputGroup
 }
 
+/**
+ * ResolveCollisions applies the configured collision policy to keycloak groups that have the same final name as an
+ *                   OpenShift group that was not created by keycloak-sync. with "adopt" the users of the OpenShift
+ *                   group become prunable so that keycloak-sync takes over the group, with "skip" the keycloak group
+ *                   is removed so the OpenShift group is not changed, and with "fail" an error naming every collision
+ *                   is returned. the returned lists are copies of the OpenShift and keycloak groups with the policy
+ *                   applied and are meant to be given to Merge.
+ */
+func ResolveCollisions(config Config, openshiftGroups GroupList, keycloakGroups GroupList) (GroupList, GroupList, error) {
+	outputOpenShift := openshiftGroups.copy()
+	outputKeycloak := keycloakGroups.copy()
+
+	collisions := make([]string, 0)
+	for name, group := range outputOpenShift {
+		if group.IsOwned() {
+			continue
+		}
+		if _, found := outputKeycloak[name]; !found {
+			continue
+		}
+		collisions = append(collisions, name)
+	}
+	if len(collisions) < 1 {
+		return outputOpenShift, outputKeycloak, nil
+	}
+	sort.Strings(collisions)
+
+	switch config.GetCollisionPolicy() {
+	case CollisionAdopt:
+		for _, name := range collisions {
+			logrus.Infof("Adopting group %s that was not created by keycloak-sync", name)
+			group := outputOpenShift[name]
+			for userName, user := range group.Users {
+				user.Prune = config.Prune
+				group.Users[userName] = user
+			}
+		}
+	case CollisionFail:
+		return outputOpenShift, outputKeycloak, fmt.Errorf("group(s) not created by keycloak-sync have the same name as keycloak groups: %s", strings.Join(collisions, ", "))
+	default:
+		for _, name := range collisions {
+			logrus.Warnf("Skipping group %s because it was not created by keycloak-sync", name)
+			delete(outputKeycloak, name)
+		}
+	}
+
+	return outputOpenShift, outputKeycloak, nil
+}
+
 func (sgs *GroupList) ToOpenShiftGroups(config Config, onlyChanged bool) userapi.GroupList {
 	// create group shell
 	groups := &userapi.GroupList{
 		TypeMeta: v1.TypeMeta{
 			Kind:       "GroupList",
-			APIVersion: userapi.GroupVersion.Version,
+			APIVersion: userapi.GroupVersion.String(),
 		},
 		ListMeta: v1.ListMeta{},
 		Items:    make([]userapi.Group, 0, len(*sgs)),
@@ -94,8 +160,22 @@ func (sgs *GroupList) ToOpenShiftGroups(config Config, onlyChanged bool) userapi
 			continue
 		}
 
+		// groups that are going to be deleted are not output
+		if group.shouldDelete(config) {
+			continue
+		}
+
 		openshiftGroup, changed := group.ToOpenShiftGroup(config)
 
+		// the content hash recorded on the group decides if it changed when there is one
+		if decided, hashChanged, drifted := group.hashChanged(openshiftGroup); decided {
+			changed = hashChanged
+			if drifted && onlyChanged {
+				logrus.Warnf("Group %s was changed outside of keycloak-sync since it was last written", group.FinalName())
+				metrics.ObserveGroupDrift()
+			}
+		}
+
 		// if we are only looking for changed group and the group
 		// has not changed then we want to skip it
 		if onlyChanged && !changed {
@@ -106,10 +186,53 @@ func (sgs *GroupList) ToOpenShiftGroups(config Config, onlyChanged bool) userapi
 		groups.Items = append(groups.Items, openshiftGroup)
 	}
 
+	// the groups are sorted by name so that the output is the same each time
+	sortOpenShiftGroups(groups.Items)
+
 	// return groups
 	return *groups
 }
 
+/**
+ * ToOpenShiftGroupDeletions returns the list of groups that should be deleted from OpenShift because they were
+ *                           created by keycloak-sync from the configured realms but no longer exist in keycloak.
+ *                           the groups only have enough information in them to identify them for deletion.
+ */
+func (sgs *GroupList) ToOpenShiftGroupDeletions(config Config) userapi.GroupList {
+	groups := &userapi.GroupList{
+		TypeMeta: v1.TypeMeta{
+			Kind:       "GroupList",
+			APIVersion: userapi.GroupVersion.String(),
+		},
+		ListMeta: v1.ListMeta{},
+		Items:    make([]userapi.Group, 0),
+	}
+
+	for _, group := range *sgs {
+		if !group.shouldDelete(config) {
+			continue
+		}
+		groups.Items = append(groups.Items, userapi.Group{
+			TypeMeta: v1.TypeMeta{
+				Kind:       "Group",
+				APIVersion: userapi.GroupVersion.String(),
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name: group.FinalName(),
+			},
+		})
+	}
+	sortOpenShiftGroups(groups.Items)
+
+	return *groups
+}
+
+func sortOpenShiftGroups(groups []userapi.Group) {
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+}
+
 func (sgs GroupList) copy() GroupList {
 	output := GroupList{}
 	for _, item := range sgs {
@@ -130,6 +253,8 @@ type Group struct {
 	Suffix            string
 	SubgroupConcat    bool
 	SubgroupSeparator string
+	// the name from the realm name template, when set this is the final name
+	TemplatedName string
 
 	// map of user names -> user
 	Users map[string]User
@@ -143,6 +268,9 @@ type Group struct {
 	Source string
 	// and a list of realms where it came from (if any)
 	Realms []string
+	// the keycloak groups or roles that the group was made from and when they were read
+	Sources  []GroupSource
+	SyncedAt time.Time
 
 	// updated when a meaningful change is made to the
 	// group. this is used to provide filtering when
@@ -154,41 +282,133 @@ type Group struct {
 	// if the group was previously skipped that doesn't
 	// mean that the children should be
 	Skipped bool
+
+	// set when a realm the group came from could not be read so the
+	// group must not be pruned or deleted
+	Kept bool
+
+	// labels, annotations, and sorted users from the openshift group (if sourced from openshift)
+	Labels      map[string]string
+	Annotations map[string]string
+	LiveUsers   []string
+
+	// labels and annotations from the realm configuration that are set on the openshift group
+	ManagedLabels      map[string]string
+	ManagedAnnotations map[string]string
 }
 
 func FromOpenShiftGroup(config Config, group userapi.Group) Group {
 	userMap := make(map[string]User)
 
+	// users can only be pruned from groups that keycloak-sync owns
+	prune := config.Prune && isOwned(group.GetAnnotations())
+
 	// add users to user map
 	for _, user := range group.Users {
 		userMap[user] = User{
 			Id:    user,
 			Name:  user,
-			Prune: config.Prune,
+			Prune: prune,
 		}
 	}
 
 	syncGroup := Group{
-		Id:       group.Name,
-		Name:     group.Name,
-		Alias:    "",
-		Prefix:   "",
-		Suffix:   "",
-		Users:    userMap,
-		Parent:   nil,
-		Children: map[string]Group{},
-		Source:   "openshift",
-		Realms:   []string{},
-		Changed:  false,
+		Id:          group.Name,
+		Name:        group.Name,
+		Alias:       "",
+		Prefix:      "",
+		Suffix:      "",
+		Users:       userMap,
+		Parent:      nil,
+		Children:    map[string]Group{},
+		Source:      "openshift",
+		Realms:      []string{},
+		Changed:     false,
+		Labels:      group.GetLabels(),
+		Annotations: group.GetAnnotations(),
+		LiveUsers:   sortedUsers(group.Users),
 	}
 
 	return syncGroup
 }
 
+/**
+ * IsOwned returns true if the group was created by keycloak-sync according to the annotations that it had
+ *         when it was read from OpenShift
+ */
+func (sg Group) IsOwned() bool {
+	return isOwned(sg.Annotations)
+}
+
+func isOwned(annotations map[string]string) bool {
+	return annotations[constants.AnnotationCreatedBy] == constants.CreatedByKeycloakSync
+}
+
+/**
+ * OwnedRealms returns the list of realms recorded on the group when it was last written by keycloak-sync
+ */
+func (sg Group) OwnedRealms() []string {
+	realms := make([]string, 0)
+	for _, realm := range strings.Split(sg.Annotations[constants.AnnotationRealms], ",") {
+		if realm = strings.TrimSpace(realm); len(realm) > 0 {
+			realms = append(realms, realm)
+		}
+	}
+	return realms
+}
+
+/**
+ * shouldDelete is true when group pruning is enabled and the group is in OpenShift, was created by keycloak-sync
+ *              from realms that are all in the current configuration, and was not found in any of those realms.
+ *              groups with no recorded realms are never deleted because it can't be known where they came from
+ *              and groups from realms that could not be read are kept.
+ */
+func (sg Group) shouldDelete(config Config) bool {
+	if !config.PruneGroups || len(sg.Realms) > 0 || !sg.IsOwned() || sg.Kept {
+		return false
+	}
+
+	ownedRealms := sg.OwnedRealms()
+	if len(ownedRealms) < 1 {
+		return false
+	}
+
+	configuredRealms := make(map[string]bool)
+	for _, realm := range config.Realms {
+		configuredRealms[realm.Name] = true
+	}
+	for _, realm := range ownedRealms {
+		if _, found := configuredRealms[realm]; !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * sortedRealms returns the realms sorted and without duplicates
+ */
+func sortedRealms(realms []string) []string {
+	sorted := make([]string, 0, len(realms))
+	found := make(map[string]bool, len(realms))
+	for _, realm := range realms {
+		if !found[realm] {
+			found[realm] = true
+			sorted = append(sorted, realm)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
 /*
  * FinalName encapsulates the name calculation logic for the Group
  */
 func (sg Group) FinalName() string {
+	if len(sg.TemplatedName) > 0 {
+		return sg.TemplatedName
+	}
 	if len(sg.Alias) > 0 {
 		return sg.Alias
 	}
@@ -239,12 +459,14 @@ func (sg *Group) ToOpenShiftGroup(config Config) (userapi.Group, bool) {
 		// add users to the list
 		users = append(users, user.Name)
 	}
+	// the users come from a map so they are sorted to keep the same order each time
+	sort.Strings(users)
 
 	// create openshift group
 	openshiftGroup := &userapi.Group{
 		TypeMeta: v1.TypeMeta{
 			Kind:       "Group",
-			APIVersion: userapi.GroupVersion.Version,
+			APIVersion: userapi.GroupVersion.String(),
 		},
 		ObjectMeta: v1.ObjectMeta{
 			Name: sg.FinalName(),
@@ -252,12 +474,26 @@ func (sg *Group) ToOpenShiftGroup(config Config) (userapi.Group, bool) {
 		Users: users,
 	}
 
-	// add annotations
-	openshiftGroup.SetAnnotations(map[string]string{
-		constants.AnnotationCreatedBy:     "keycloak-sync",
-		constants.AnnotationPrimarySource: sg.Source,
-		constants.AnnotationRealms:        strings.Join(sg.Realms, ","),
-	})
+	// add labels and annotations, the ones that keycloak-sync uses are set last so that they can't be replaced
+	labels := copyStringMap(sg.ManagedLabels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[constants.LabelManagedBy] = constants.CreatedByKeycloakSync
+	openshiftGroup.SetLabels(labels)
+
+	annotations := copyStringMap(sg.ManagedAnnotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[constants.AnnotationCreatedBy] = constants.CreatedByKeycloakSync
+	annotations[constants.AnnotationPrimarySource] = sg.Source
+	annotations[constants.AnnotationRealms] = strings.Join(sortedRealms(sg.Realms), ",")
+	for key, value := range provenanceAnnotations(*sg) {
+		annotations[key] = value
+	}
+	openshiftGroup.SetAnnotations(annotations)
+	openshiftGroup.Annotations[constants.AnnotationContentHash] = contentHash(*openshiftGroup)
 
 	// return the group and the status on if it was changed or not
 	// meaning that it was either changed by another step or the users
@@ -275,8 +511,13 @@ func (sg Group) copy() Group {
 	}
 
 	// copy realms
-	realms := make([]string, 0, len(sg.Realms))
+	realms := make([]string, len(sg.Realms))
 	copy(realms, sg.Realms)
+	var sources []GroupSource
+	if sg.Sources != nil {
+		sources = make([]GroupSource, len(sg.Sources))
+		copy(sources, sg.Sources)
+	}
 
 	children := make(map[string]Group)
 	for _, child := range sg.Children {
@@ -284,20 +525,31 @@ func (sg Group) copy() Group {
 	}
 
 	group := Group{
-		Id:                sg.Id,
-		Name:              sg.Name,
-		Alias:             sg.Alias,
-		Path:              sg.Path,
-		Prefix:            sg.Prefix,
-		Suffix:            sg.Suffix,
-		SubgroupConcat:    sg.SubgroupConcat,
-		SubgroupSeparator: sg.SubgroupSeparator,
-		Users:             users,
-		Source:            sg.Source,
-		Realms:            realms,
-		Changed:           sg.Changed,
-		Children:          children,
-		Skipped:           sg.Skipped,
+		Id:                 sg.Id,
+		Name:               sg.Name,
+		Alias:              sg.Alias,
+		Path:               sg.Path,
+		Prefix:             sg.Prefix,
+		Suffix:             sg.Suffix,
+		SubgroupConcat:     sg.SubgroupConcat,
+		SubgroupSeparator:  sg.SubgroupSeparator,
+		TemplatedName:      sg.TemplatedName,
+		Users:              users,
+		Source:             sg.Source,
+		Realms:             realms,
+		Sources:            sources,
+		SyncedAt:           sg.SyncedAt,
+		Changed:            sg.Changed,
+		Children:           children,
+		Skipped:            sg.Skipped,
+		Kept:               sg.Kept,
+		Labels:             copyStringMap(sg.Labels),
+		Annotations:        copyStringMap(sg.Annotations),
+		ManagedLabels:      copyStringMap(sg.ManagedLabels),
+		ManagedAnnotations: copyStringMap(sg.ManagedAnnotations),
+	}
+	if sg.LiveUsers != nil {
+		group.LiveUsers = append([]string{}, sg.LiveUsers...)
 	}
 
 	// copy parent
@@ -316,6 +568,8 @@ type User struct {
 	Id    string
 	Name  string
 	Prune bool
+	// the keycloak path of the subgroup that the user was added from, empty when the user is a member of the group
+	Via string
 }
 
 func (u User) copy() User {
@@ -323,5 +577,6 @@ func (u User) copy() User {
 		Id:    u.Id,
 		Name:  u.Name,
 		Prune: u.Prune,
+		Via:   u.Via,
 	}
 }
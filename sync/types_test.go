@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func ownedTestGroups(config Config, t *testing.T) GroupList {
+	openshiftGroups, err := GetOpenShiftGroupsFromReader(config, loadTestGroupFile("input-group-owned.yml", t))
+	if err != nil {
+		t.Fatalf("could not read owned groups: %s", err)
+	}
+	keycloakGroups := GroupList{
+		"sso-current": Group{Name: "sso-current", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test1": {Name: "test1"},
+		}},
+	}
+	return Merge(openshiftGroups, keycloakGroups)
+}
+
+func TestIsOwned(t *testing.T) {
+	a := assert.New(t)
+
+	groups := ownedTestGroups(Config{}, t)
+	a.True(groups["sso-removed"].IsOwned())
+	a.Equal([]string{"sso", "partner"}, groups["partner-removed"].OwnedRealms())
+	a.False(groups["handmade"].IsOwned())
+	a.Empty(groups["handmade"].OwnedRealms())
+}
+
+func TestGroupDeletions(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{
+		Prune:       true,
+		PruneGroups: true,
+		Realms:      []RealmConfig{{Name: "sso"}},
+	}
+	groups := ownedTestGroups(config, t)
+
+	// only the group owned by the configured realm that is no longer in keycloak is deleted
+	deletions := groups.ToOpenShiftGroupDeletions(config)
+	a.Equal(1, len(deletions.Items))
+	a.Equal("sso-removed", deletions.Items[0].Name)
+	a.Equal("user.openshift.io/v1", deletions.Items[0].APIVersion)
+
+	// and the deleted group is not also output as an update
+	for _, group := range groups.ToOpenShiftGroups(config, true).Items {
+		a.NotEqual("sso-removed", group.Name)
+	}
+
+	// with both realms configured the group from both realms is deleted as well
+	config.Realms = append(config.Realms, RealmConfig{Name: "partner"})
+	deletions = groups.ToOpenShiftGroupDeletions(config)
+	a.Equal(2, len(deletions.Items))
+}
+
+func TestGroupDeletionsDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{
+		Prune:  true,
+		Realms: []RealmConfig{{Name: "sso"}},
+	}
+	groups := ownedTestGroups(config, t)
+
+	a.Empty(groups.ToOpenShiftGroupDeletions(config).Items)
+}
+
+func TestUnownedUsersNotPruned(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{Prune: true}
+	groups, err := GetOpenShiftGroupsFromReader(config, loadTestGroupFile("input-group-owned.yml", t))
+	a.Nil(err)
+	a.True(groups["sso-removed"].Users["test1"].Prune)
+	a.False(groups["handmade"].Users["test4"].Prune)
+
+	// the unowned group is not changed so it is not output
+	for _, group := range groups.ToOpenShiftGroups(config, true).Items {
+		a.NotEqual("handmade", group.Name)
+	}
+}
+
+func collisionTestGroups(t *testing.T) (GroupList, GroupList) {
+	openshiftGroups, err := GetOpenShiftGroupsFromReader(Config{Prune: true}, loadTestGroupFile("input-group-owned.yml", t))
+	if err != nil {
+		t.Fatalf("could not read owned groups: %s", err)
+	}
+	keycloakGroups := GroupList{
+		"handmade": Group{Name: "handmade", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test1": {Name: "test1"},
+		}},
+		"sso-current": Group{Name: "sso-current", Source: "realm:sso", Realms: []string{"sso"}, Changed: true, Users: map[string]User{
+			"test1": {Name: "test1"},
+		}},
+	}
+	return openshiftGroups, keycloakGroups
+}
+
+func TestCollisionSkip(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{Prune: true}
+	openshiftGroups, keycloakGroups := collisionTestGroups(t)
+	openshiftGroups, keycloakGroups, err := ResolveCollisions(config, openshiftGroups, keycloakGroups)
+	a.Nil(err)
+	a.NotContains(keycloakGroups, "handmade")
+	a.Contains(keycloakGroups, "sso-current")
+
+	merged := Merge(openshiftGroups, keycloakGroups)
+	a.Equal(1, len(merged["handmade"].Users))
+	a.False(merged["handmade"].Changed)
+}
+
+func TestCollisionAdopt(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{Prune: true, Collisions: CollisionAdopt}
+	openshiftGroups, keycloakGroups := collisionTestGroups(t)
+	openshiftGroups, keycloakGroups, err := ResolveCollisions(config, openshiftGroups, keycloakGroups)
+	a.Nil(err)
+	a.Contains(keycloakGroups, "handmade")
+
+	// the users of the adopted group are replaced by the users from keycloak
+	merged := Merge(openshiftGroups, keycloakGroups)
+	for _, group := range merged.ToOpenShiftGroups(config, true).Items {
+		if group.Name == "handmade" {
+			a.Equal([]string{"test1"}, []string(group.Users))
+			return
+		}
+	}
+	t.Error("adopted group was not output")
+}
+
+func TestCollisionFail(t *testing.T) {
+	a := assert.New(t)
+
+	config := Config{Prune: true, Collisions: CollisionFail}
+	openshiftGroups, keycloakGroups := collisionTestGroups(t)
+	_, _, err := ResolveCollisions(config, openshiftGroups, keycloakGroups)
+	a.Error(err)
+	a.Contains(err.Error(), "handmade")
+}
@@ -0,0 +1,87 @@
+package sync
+
+import (
+	"github.com/Nerzal/gocloak/v7"
+	"strings"
+)
+
+/**
+ * builtInUsernameFields maps the names that can be used in the `preferred-username` configuration to the
+ *                       value on the keycloak user representation. the names mirror the claims that can be
+ *                       used when configuring an OpenShift OIDC identity provider as well as the keycloak field
+ *                       names so that either can be used in the configuration.
+ */
+var builtInUsernameFields = map[string]func(user *gocloak.User) *string{
+	"username":           func(user *gocloak.User) *string { return user.Username },
+	"preferred_username": func(user *gocloak.User) *string { return user.Username },
+	"email":              func(user *gocloak.User) *string { return user.Email },
+	"firstname":          func(user *gocloak.User) *string { return user.FirstName },
+	"given_name":         func(user *gocloak.User) *string { return user.FirstName },
+	"lastname":           func(user *gocloak.User) *string { return user.LastName },
+	"family_name":        func(user *gocloak.User) *string { return user.LastName },
+	"id":                 func(user *gocloak.User) *string { return user.ID },
+	"sub":                func(user *gocloak.User) *string { return user.ID },
+}
+
+/**
+ * resolveUsername walks the list of preferred username sources and returns the first non-empty value found for
+ *                 the given user. built in names (username, email, firstName, etc) are checked first and any
+ *                 other value is treated as the name of a keycloak user attribute. if no list is given then the
+ *                 keycloak username is used. the boolean return is false if no value could be resolved.
+ */
+func resolveUsername(preferred []string, user *gocloak.User) (string, bool) {
+	if user == nil {
+		return "", false
+	}
+
+	// with no configuration the username is the only source
+	if len(preferred) < 1 {
+		preferred = []string{"username"}
+	}
+
+	for _, source := range preferred {
+		source = strings.TrimSpace(source)
+		if len(source) < 1 {
+			continue
+		}
+
+		// check built in fields first
+		if field, found := builtInUsernameFields[strings.ToLower(source)]; found {
+			if value := field(user); value != nil && len(strings.TrimSpace(*value)) > 0 {
+				return strings.TrimSpace(*value), true
+			}
+			continue
+		}
+
+		// fall back to user attributes which are multi-valued so the first non-empty value is used
+		if user.Attributes == nil {
+			continue
+		}
+		if values, found := (*user.Attributes)[source]; found {
+			for _, value := range values {
+				if len(strings.TrimSpace(value)) > 0 {
+					return strings.TrimSpace(value), true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
+/**
+ * describeUser gives a short identifying description of a user for logging that works even when the user
+ *              could not be resolved to a name
+ */
+func describeUser(user *gocloak.User) string {
+	if user == nil {
+		return "<nil>"
+	}
+	if user.Username != nil && len(*user.Username) > 0 {
+		return *user.Username
+	}
+	if user.ID != nil {
+		return *user.ID
+	}
+	return "<unknown>"
+}
@@ -0,0 +1,76 @@
+package sync
+
+import (
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testUser() *gocloak.User {
+	id := "3b4e2c"
+	username := "jdoe"
+	email := "jdoe@example.com"
+	first := "Jane"
+	attributes := map[string][]string{
+		"upn":   {"", "jdoe@corp.example.com"},
+		"empty": {""},
+	}
+	return &gocloak.User{
+		ID:         &id,
+		Username:   &username,
+		Email:      &email,
+		FirstName:  &first,
+		Attributes: &attributes,
+	}
+}
+
+func TestResolveUsernameDefault(t *testing.T) {
+	a := assert.New(t)
+
+	name, resolved := resolveUsername(nil, testUser())
+	a.True(resolved)
+	a.Equal("jdoe", name)
+}
+
+func TestResolveUsernameBuiltIns(t *testing.T) {
+	a := assert.New(t)
+
+	name, resolved := resolveUsername([]string{"email"}, testUser())
+	a.True(resolved)
+	a.Equal("jdoe@example.com", name)
+
+	name, resolved = resolveUsername([]string{"firstName"}, testUser())
+	a.True(resolved)
+	a.Equal("Jane", name)
+
+	name, resolved = resolveUsername([]string{"preferred_username"}, testUser())
+	a.True(resolved)
+	a.Equal("jdoe", name)
+}
+
+func TestResolveUsernameAttribute(t *testing.T) {
+	a := assert.New(t)
+
+	name, resolved := resolveUsername([]string{"upn", "username"}, testUser())
+	a.True(resolved)
+	a.Equal("jdoe@corp.example.com", name)
+}
+
+func TestResolveUsernameFallback(t *testing.T) {
+	a := assert.New(t)
+
+	// lastName is not set and the "empty" attribute has no usable value so email is used
+	name, resolved := resolveUsername([]string{"lastName", "empty", "missing", "email"}, testUser())
+	a.True(resolved)
+	a.Equal("jdoe@example.com", name)
+}
+
+func TestResolveUsernameUnresolved(t *testing.T) {
+	a := assert.New(t)
+
+	_, resolved := resolveUsername([]string{"lastName", "missing"}, testUser())
+	a.False(resolved)
+
+	_, resolved = resolveUsername([]string{"username"}, nil)
+	a.False(resolved)
+}
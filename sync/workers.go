@@ -0,0 +1,39 @@
+package sync
+
+import (
+	gosync "sync"
+)
+
+/**
+ * runWorkers calls the work function once for each index in [0, count) using at most the given number of
+ *            concurrent workers and returns when all of the work is done. the work function is expected to
+ *            store its results by index so that the caller can consume them in a deterministic order no matter
+ *            what order the work completes in.
+ */
+func runWorkers(workers int, count int, work func(idx int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > count {
+		workers = count
+	}
+
+	indexes := make(chan int)
+	waitGroup := gosync.WaitGroup{}
+	for worker := 0; worker < workers; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for idx := range indexes {
+				work(idx)
+			}
+		}()
+	}
+
+	for idx := 0; idx < count; idx++ {
+		indexes <- idx
+	}
+	close(indexes)
+
+	waitGroup.Wait()
+}
@@ -0,0 +1,46 @@
+package sync
+
+import (
+	"github.com/stretchr/testify/assert"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+func TestRunWorkersBounded(t *testing.T) {
+	a := assert.New(t)
+
+	mutex := gosync.Mutex{}
+	running := 0
+	maxRunning := 0
+	done := make([]bool, 20)
+
+	runWorkers(3, len(done), func(idx int) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		done[idx] = true
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	})
+
+	a.Equal(3, maxRunning)
+	for _, item := range done {
+		a.True(item)
+	}
+}
+
+func TestRunWorkersNoWork(t *testing.T) {
+	called := false
+	runWorkers(4, 0, func(idx int) {
+		called = true
+	})
+	assert.False(t, called)
+}